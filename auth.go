@@ -0,0 +1,154 @@
+package sharedir
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// File in a shared directory with credentials required for it
+// and its subdirectories, one 'user:password' per line. The
+// password can be given as '{SHA}' and the base64-encoded SHA-1
+// hash, like 'htpasswd -s' writes it.
+const authFile = ".sharedir-auth"
+
+const authCached = 1024 // number of parsed auth files kept in memory
+
+// Parsed auth file, valid as long as it isn't modified.
+type dirAuth struct {
+	modified time.Time
+	users    map[string]string // password (or {SHA} hash) by user
+}
+
+// Find the auth file that applies to sp, i.e. the one in the
+// closest directory containing sp. Returns the directory and
+// nil if there is none.
+func (s *Server) authOf(sp *safePath, isDir bool) (*safePath, *dirAuth, error) {
+	dir := sp.name
+	if !isDir {
+		dir = path.Dir(dir)
+	}
+
+	for {
+		p := s.rootOf(sp).child(dir)
+		a, err := s.readAuth(p)
+		if a != nil || err != nil {
+			return p, a, err
+		}
+		if dir == "." {
+			return nil, nil, nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// Path of the root of the mount sp is in.
+func (s *Server) rootOf(sp *safePath) *safePath {
+	for i := range s.mounts {
+		if s.mounts[i].root == sp.root {
+			return s.rootPath(&s.mounts[i])
+		}
+	}
+	return nil
+}
+
+// Read auth file of directory dir, nil if there is none.
+// Parsed files are cached until they are modified.
+func (s *Server) readAuth(dir *safePath) (*dirAuth, error) {
+	f := dir.child(authFile)
+
+	inf, err := fs.Stat(f.fsys, f.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	key := f.abs
+	if a, ok := s.auths.get(key); ok && a.modified.Equal(inf.ModTime()) {
+		return a, nil
+	}
+
+	data, err := fs.ReadFile(f.fsys, f.name)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &dirAuth{modified: inf.ModTime(), users: make(map[string]string)}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, pass, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected 'user:password'", f.abs, n)
+		}
+		a.users[user] = pass
+	}
+
+	s.auths.put(key, a)
+	return a, nil
+}
+
+// Check credentials of the request against the auth file
+// that applies to sp, if any. Otherwise the request is failed
+// with 401 (or 500 if the file can't be read) and false is
+// returned.
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request, sp *safePath, isDir bool) bool {
+	dir, a, err := s.authOf(sp, isDir)
+	if err != nil {
+		log.Printf("     read %s: %v", authFile, err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return false
+	}
+	if a == nil {
+		return true
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok && a.check(user, pass) {
+		debugf("     authorized as '%s' for [%s]", user, dir.abs)
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="sharedir /%s", charset="UTF-8"`, dir.rel))
+	serveFailure(w, r, http.StatusUnauthorized, "unauthorized")
+	return false
+}
+
+func (a *dirAuth) check(user, pass string) bool {
+	want, ok := a.users[user]
+	if !ok {
+		// compare anyway, so that timing doesn't reveal unknown users
+		want = "\x00"
+	}
+
+	if h, found := strings.CutPrefix(want, "{SHA}"); found {
+		sum := sha1.Sum([]byte(pass))
+		pass, want = base64.StdEncoding.EncodeToString(sum[:]), h
+	}
+
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1 && ok
+}
+
+// Check if directory dir has an auth file of its own. Such
+// directories are skipped where requests for them aren't
+// checked individually (archives and search).
+func protected(dir *safePath) bool {
+	f := dir.child(authFile)
+	_, err := fs.Stat(f.fsys, f.name)
+	return err == nil
+}
@@ -0,0 +1,127 @@
+package sharedir
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirAuth(t *testing.T) {
+	sum := sha1.Sum([]byte("hashed"))
+	dir := testDir(t, map[string]string{
+		"pub.txt":              "pub",
+		"priv/" + authFile:     "# team\nalice:secret\nbob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\n",
+		"priv/a.txt":           "a",
+		"priv/sub/b.txt":       "b",
+		"priv/sub/" + authFile: "carol:other\n",
+		"other/c.txt":          "c",
+	})
+	cfg := testConfig(dir)
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		user   string
+		pass   string
+		code   int
+	}{
+		{"/pub.txt", "", "", http.StatusOK},
+		{"/", "", "", http.StatusOK},
+		{"/other/c.txt", "", "", http.StatusOK},
+		{"/priv/a.txt", "", "", http.StatusUnauthorized},
+		{"/priv/", "", "", http.StatusUnauthorized},
+		{"/priv/a.txt", "alice", "secret", http.StatusOK},
+		{"/priv/", "alice", "secret", http.StatusOK},
+		{"/priv/a.txt", "alice", "wrong", http.StatusUnauthorized},
+		{"/priv/a.txt", "bob", "hashed", http.StatusOK},
+		{"/priv/a.txt", "mallory", "", http.StatusUnauthorized},
+		// the closest auth file applies
+		{"/priv/sub/b.txt", "alice", "secret", http.StatusUnauthorized},
+		{"/priv/sub/b.txt", "carol", "other", http.StatusOK},
+		{"/priv/" + authFile, "alice", "secret", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := send(s, r)
+		if w.Code != tt.code {
+			t.Errorf("%s as %q: status %d, want %d", tt.target, tt.user, w.Code, tt.code)
+		}
+		if wa := w.Header().Get("WWW-Authenticate"); (w.Code == http.StatusUnauthorized) != (wa != "") {
+			t.Errorf("%s as %q: WWW-Authenticate %q", tt.target, tt.user, wa)
+		}
+	}
+
+	// the protected directory is listed, its content isn't
+	if got := listingNames(t, s, "/"); !slices.Equal(got, []string{"other", "priv", "pub.txt"}) {
+		t.Errorf("listing %q", got)
+	}
+	if w := request(s, http.MethodGet, "/?zip=1"); w.Code != http.StatusOK || !slices.Equal(slices.Sorted(maps.Keys(zipContents(t, w.Body.Bytes()))), []string{"other/c.txt", "pub.txt"}) {
+		t.Errorf("zip: status %d", w.Code)
+	}
+}
+
+// Auth files are never served or listed, whatever the case of
+// their names, which may not matter to the file system.
+func TestAuthFileCase(t *testing.T) {
+	upper := strings.ToUpper(authFile)
+	cfg := testConfig(testDir(t, map[string]string{upper: "alice:secret\n", "a.txt": "a"}))
+	cfg.Hidden = true
+	s := testServer(t, cfg)
+
+	if w := request(s, http.MethodGet, "/"+upper); w.Code != http.StatusNotFound {
+		t.Errorf("status %d", w.Code)
+	}
+	if got := listingNames(t, s, "/"); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("listing %q", got)
+	}
+}
+
+// Changed auth files apply without restarting.
+func TestDirAuthChanged(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"priv/" + authFile: "alice:secret\n",
+		"priv/a.txt":       "a",
+	})
+	cfg := testConfig(dir)
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	get := func(user, pass string) int {
+		r := httptest.NewRequest(http.MethodGet, "/priv/a.txt", nil)
+		r.SetBasicAuth(user, pass)
+		return send(s, r).Code
+	}
+
+	if code := get("alice", "secret"); code != http.StatusOK {
+		t.Fatalf("before: status %d", code)
+	}
+
+	fp := filepath.Join(dir, "priv", authFile)
+	if err := os.WriteFile(fp, []byte("alice:changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(time.Second)
+	if err := os.Chtimes(fp, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := get("alice", "secret"); code != http.StatusUnauthorized {
+		t.Errorf("old password: status %d", code)
+	}
+	if code := get("alice", "changed"); code != http.StatusOK {
+		t.Errorf("new password: status %d", code)
+	}
+}
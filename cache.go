@@ -0,0 +1,80 @@
+package sharedir
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cache of at most size recently used values, least recently
+// used ones are evicted first.
+type lruCache[V any] struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List // front is the most recently used
+}
+
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{size: size, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry[V]).value, true
+	}
+
+	var zero V
+	return zero, false
+}
+
+func (c *lruCache[V]) put(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry[V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key, value})
+	if c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*lruEntry[V]).key)
+	}
+}
+
+// Rendered directory listing, valid as long as the directory
+// isn't modified, i.e. no entries are added, removed or renamed.
+// Changes of files themselves (e.g. their size) are not noticed.
+type cachedListing struct {
+	modified    time.Time
+	contentType string
+	body        []byte
+}
+
+// Response writer keeping the response in memory, the status
+// is ignored.
+type bufferWriter struct {
+	bytes.Buffer
+	header http.Header
+}
+
+func (b *bufferWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferWriter) WriteHeader(int) {}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Readable names of the single-letter flags, the other options
+// in config files and environment variables are named as flags.
+var configAliases = map[string]string{
+	"recursive": "r",
+	"hidden":    "A",
+	"addr":      "a",
+	"verbose":   "v",
+}
+
+// Set option k in fs to v. Returns an error if there is no such
+// option or the value is invalid.
+func setOption(fs *flag.FlagSet, k, v string) error {
+	name := k
+	if a, ok := configAliases[k]; ok {
+		name = a
+	} else if len(k) == 1 || k == "config" || k == "version" {
+		name = ""
+	}
+
+	if name == "" || fs.Lookup(name) == nil {
+		return fmt.Errorf("unknown option '%s'", k)
+	}
+	if err := fs.Set(name, v); err != nil {
+		return fmt.Errorf("invalid value for '%s': %s", k, v)
+	}
+	return nil
+}
+
+// Read config file with lines of 'key = value' and set the options
+// in fs. Empty lines and lines starting with '#' are ignored, values
+// can be quoted. Directories ('root') are returned, since the ones
+// given on the command line replace them.
+func readConfig(fs *flag.FlagSet, fp string) (dirs []string, err error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected 'key = value'", fp, n)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+
+		if strings.HasPrefix(v, `"`) {
+			if v, err = strconv.Unquote(v); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value", fp, n)
+			}
+		}
+
+		if k == "root" {
+			dirs = append(dirs, v)
+		} else if err = setOption(fs, k, v); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fp, n, err)
+		}
+	}
+
+	return dirs, sc.Err()
+}
+
+// Set options in fs from environment variables named SHAREDIR_
+// and the config key in upper case, with '_' instead of '-' (e.g.
+// SHAREDIR_MAX_CONN). SHAREDIR_ROOT can list several directories,
+// separated like in PATH, they are returned.
+func readEnv(fs *flag.FlagSet) (dirs []string, err error) {
+	var keys []string
+
+	for k := range configAliases {
+		keys = append(keys, k)
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) > 1 && f.Name != "config" && f.Name != "version" {
+			keys = append(keys, f.Name)
+		}
+	})
+	// stable order, for options that can be given several times
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		name := "SHAREDIR_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok {
+			if err = setOption(fs, k, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	if v := os.Getenv("SHAREDIR_ROOT"); v != "" {
+		dirs = filepath.SplitList(v)
+	}
+
+	return dirs, nil
+}
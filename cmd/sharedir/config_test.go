@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vgratian/sharedir"
+)
+
+// Parse options as main does, from the config file conf (none if
+// empty), the environment and args.
+func loadOptions(t *testing.T, conf string, args ...string) options {
+	t.Helper()
+
+	o := defaultOptions()
+	fs := newFlagSet(&o)
+
+	if conf != "" {
+		o.source = fromConfig
+		if _, err := readConfig(fs, writeConfig(t, conf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o.source = fromEnv
+	if _, err := readEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	o.source = fromArgs
+	if _, err := parseArgs(fs, args); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestListPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		env  string // SHAREDIR_EXT
+		args []string
+		want []string
+	}{
+		{"config", "ext = jpg\next = png\n", "", nil, []string{".jpg", ".png"}},
+		{"env replaces config", "ext = jpg\n", "gif", nil, []string{".gif"}},
+		{"args replace config", "ext = jpg\n", "", []string{"-ext", "pdf"}, []string{".pdf"}},
+		{"args replace env", "", "gif", []string{"-ext", "pdf", "-ext", "txt"}, []string{".pdf", ".txt"}},
+		{"args replace both", "ext = jpg\n", "gif", []string{"-ext", "pdf"}, []string{".pdf"}},
+		{"kept if not given", "ext = jpg\n", "", []string{"-r"}, []string{".jpg"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("SHAREDIR_EXT", tt.env)
+			}
+			o := loadOptions(t, tt.conf, tt.args...)
+			if !slices.Equal(o.cfg.Extensions, tt.want) {
+				t.Errorf("extensions %q, want %q", o.cfg.Extensions, tt.want)
+			}
+		})
+	}
+}
+
+func TestListPrecedenceOthers(t *testing.T) {
+	conf := "allow = 10.0.0.0/8\ntrust-proxy = 10.0.0.1\nno-ext = exe\nmime = md=text/plain\nmime = go=text/x-go\n"
+	o := loadOptions(t, conf, "-allow", "192.168.0.0/16", "-trust-proxy", "192.168.0.1", "-no-ext", "bat", "-mime", "log=text/plain")
+
+	if len(o.allow) != 1 || o.allow[0].String() != "192.168.0.0/16" {
+		t.Errorf("allow %v", o.allow)
+	}
+	if len(o.trust) != 1 || o.trust[0].String() != "192.168.0.1/32" {
+		t.Errorf("trust-proxy %v", o.trust)
+	}
+	if !slices.Equal(o.cfg.NoExtensions, []string{".bat"}) {
+		t.Errorf("no-ext %q", o.cfg.NoExtensions)
+	}
+	if len(o.cfg.MimeTypes) != 1 || o.cfg.MimeTypes[".log"] != "text/plain" {
+		t.Errorf("mime %v", o.cfg.MimeTypes)
+	}
+}
+
+// Options only for the command line are refused elsewhere.
+func TestVersionOption(t *testing.T) {
+	if o := loadOptions(t, "", "-version"); !o.version {
+		t.Error("-version not set")
+	}
+
+	o := defaultOptions()
+	if _, err := readConfig(newFlagSet(&o), writeConfig(t, "version = true\n")); err == nil {
+		t.Error("version accepted in config file")
+	}
+
+	for _, arg := range []string{"-version", "--version"} {
+		if out, code := runMain(t, arg); code != 0 || out != "sharedir "+sharedir.Version+"\n" {
+			t.Errorf("%s: exit code %d, output %q", arg, code, out)
+		}
+	}
+}
+
+// Write conf to a file and return its path.
+func writeConfig(t *testing.T, conf string) string {
+	t.Helper()
+
+	fp := filepath.Join(t.TempDir(), "sharedir.conf")
+	if err := os.WriteFile(fp, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fp
+}
+
+func TestReadConfig(t *testing.T) {
+	conf := `# shared with the team
+recursive = true
+addr = "127.0.0.1:8080"
+
+root = /srv/docs
+root = "/srv/with space"
+max-conn = 4
+  hidden=false
+`
+	o := defaultOptions()
+	dirs, err := readConfig(newFlagSet(&o), writeConfig(t, conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(dirs, []string{"/srv/docs", "/srv/with space"}) {
+		t.Errorf("dirs %q", dirs)
+	}
+	if !o.cfg.Recursive || o.cfg.Hidden || o.addr != "127.0.0.1:8080" || o.cfg.MaxTransfers != 4 {
+		t.Errorf("recursive %t, hidden %t, addr %q, max-conn %d", o.cfg.Recursive, o.cfg.Hidden, o.addr, o.cfg.MaxTransfers)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	tests := []struct {
+		conf string
+		want string // in the error
+	}{
+		{"recursive = true\nbogus = 1\n", ":2: unknown option 'bogus'"},
+		{"r = true\n", ":1: unknown option 'r'"},
+		{"config = other.conf\n", "unknown option 'config'"},
+		{"max-conn = many\n", ":1: invalid value for 'max-conn'"},
+		{"recursive\n", ":1: expected 'key = value'"},
+		{"addr = \"unterminated\n", ":1: invalid quoted value"},
+	}
+
+	for _, tt := range tests {
+		o := defaultOptions()
+		if _, err := readConfig(newFlagSet(&o), writeConfig(t, tt.conf)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: %v, want %q", tt.conf, err, tt.want)
+		}
+	}
+
+	o := defaultOptions()
+	if _, err := readConfig(newFlagSet(&o), filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+// Command-line options override those of the config file.
+func TestConfigPrecedence(t *testing.T) {
+	o := loadOptions(t, "recursive = true\naddr = :8080\nmax-conn = 4\n", "-a", ":9090", "-max-conn", "8")
+
+	if !o.cfg.Recursive || o.addr != ":9090" || o.cfg.MaxTransfers != 8 {
+		t.Errorf("recursive %t, addr %q, max-conn %d", o.cfg.Recursive, o.addr, o.cfg.MaxTransfers)
+	}
+}
+
+func TestReadEnv(t *testing.T) {
+	t.Setenv("SHAREDIR_ADDR", "127.0.0.1:8080")
+	t.Setenv("SHAREDIR_RECURSIVE", "true")
+	t.Setenv("SHAREDIR_MAX_CONN", "4")
+	t.Setenv("SHAREDIR_ROOT", strings.Join([]string{"/srv/a", "/srv/b"}, string(os.PathListSeparator)))
+
+	o := defaultOptions()
+	dirs, err := readEnv(newFlagSet(&o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(dirs, []string{"/srv/a", "/srv/b"}) {
+		t.Errorf("dirs %q", dirs)
+	}
+	if !o.cfg.Recursive || o.addr != "127.0.0.1:8080" || o.cfg.MaxTransfers != 4 {
+		t.Errorf("recursive %t, addr %q, max-conn %d", o.cfg.Recursive, o.addr, o.cfg.MaxTransfers)
+	}
+
+	t.Setenv("SHAREDIR_MAX_CONN", "many")
+	if _, err := readEnv(newFlagSet(&o)); err == nil || !strings.Contains(err.Error(), "SHAREDIR_MAX_CONN") {
+		t.Errorf("invalid value: %v", err)
+	}
+}
+
+// Options given on the command line override the environment,
+// which overrides the config file and the defaults.
+func TestEnvPrecedence(t *testing.T) {
+	t.Setenv("SHAREDIR_ADDR", ":8080")
+	t.Setenv("SHAREDIR_MAX_CONN", "4")
+
+	o := loadOptions(t, "addr = :7070\nmax-conn = 2\nhidden = true\n", "-a", ":9090")
+	if o.addr != ":9090" || o.cfg.MaxTransfers != 4 || !o.cfg.Hidden || o.cfg.Recursive {
+		t.Errorf("addr %q, max-conn %d, hidden %t, recursive %t", o.addr, o.cfg.MaxTransfers, o.cfg.Hidden, o.cfg.Recursive)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vgratian/sharedir"
+)
+
+// Options given on the command line, in the config file or
+// environment variables.
+type options struct {
+	cfg  sharedir.Config
+	addr string
+	cert string // TLS certificate file
+	key  string // TLS private key file
+
+	user string // username for basic authentication
+	pass string // password for basic authentication
+
+	logf string  // format of request logs
+	logp string  // file to write logs to, stderr if empty
+	rate float64 // requests per second per client, 0 if unlimited
+	wait time.Duration
+	ttl  time.Duration // time until the server stops, 0 if unlimited
+
+	allow []*net.IPNet // networks allowed to access, all if empty
+	trust []*net.IPNet // proxies whose X-Forwarded-For is trusted
+	cors  corsOrigin   // origin allowed for cross-origin requests, none if empty
+
+	selfsign  bool // serve TLS with a generated certificate
+	logtee    bool // write logs to stderr as well as to the file
+	qr        bool // print QR code of the URL
+	open      bool // open the URL in the browser
+	version   bool // print version and exit
+	dryRun    bool // check configuration and exit
+	http2     bool // serve HTTP/2 without TLS (h2c)
+	autoPort  bool // try the next ports if the one of addr is in use
+	verbosity sharedir.LogLevel
+	config    string // file to read options from
+	mdns      string // name to announce via mDNS, none if empty
+
+	// source of the options being parsed, and the one each option
+	// that can be given several times was last set from
+	source int
+	lists  map[string]int
+}
+
+// Sources of options, in order of precedence.
+const (
+	fromDefault = iota
+	fromConfig
+	fromEnv
+	fromArgs
+)
+
+func defaultOptions() options {
+	return options{
+		cfg:       sharedir.DefaultConfig(),
+		addr:      ":2022",
+		wait:      time.Minute,
+		logf:      "default",
+		verbosity: sharedir.LogInfo,
+		lists:     make(map[string]int),
+	}
+}
+
+// Check if option name, which can be given several times, is set
+// from the current source for the first time. Its values are then
+// replaced rather than added to, so that e.g. '-ext' on the command
+// line overrides the extensions in the config file.
+func (o *options) replaceList(name string) bool {
+	if o.lists[name] == o.source {
+		return false
+	}
+	o.lists[name] = o.source
+	return true
+}
+
+// Create flag set that stores the options in o. Values are
+// checked while parsing. The usage text is printed by the caller.
+func newFlagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("sharedir", flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	fs.Usage = func() {}
+
+	fs.BoolVar(&o.cfg.Recursive, "r", o.cfg.Recursive, "")
+	fs.BoolVar(&o.cfg.Hidden, "A", o.cfg.Hidden, "")
+	fs.BoolVar(&o.cfg.FollowSymlinks, "follow-symlinks", o.cfg.FollowSymlinks, "")
+	fs.BoolVar(&o.cfg.Upload, "upload", o.cfg.Upload, "")
+	fs.BoolVar(&o.cfg.WebDAV, "webdav", o.cfg.WebDAV, "")
+	fs.BoolVar(&o.cfg.Markdown, "markdown", o.cfg.Markdown, "")
+	fs.BoolVar(&o.cfg.Preview, "preview", o.cfg.Preview, "")
+	fs.BoolVar(&o.cfg.Thumbnails, "thumbnails", o.cfg.Thumbnails, "")
+	fs.BoolVar(&o.cfg.CacheListings, "cache-listings", o.cfg.CacheListings, "")
+	fs.BoolVar(&o.cfg.Once, "once", o.cfg.Once, "")
+	fs.BoolVar(&o.cfg.NoListing, "no-listing", o.cfg.NoListing, "")
+	fs.BoolVar(&o.cfg.IgnoreCase, "ci", o.cfg.IgnoreCase, "")
+	fs.BoolVar(&o.cfg.Manifest, "manifest", o.cfg.Manifest, "")
+	fs.BoolVar(&o.cfg.Live, "live", o.cfg.Live, "")
+	fs.StringVar(&o.cfg.Secret, "secret", o.cfg.Secret, "")
+	fs.BoolVar(&o.cfg.SignedOnly, "signed-only", o.cfg.SignedOnly, "")
+	fs.Func("secret-ttl", "", func(v string) (err error) {
+		if o.cfg.SecretTTL, err = time.ParseDuration(v); err == nil && o.cfg.SecretTTL <= 0 {
+			err = errors.New("must be positive")
+		}
+		return err
+	})
+	fs.StringVar(&o.cfg.Template, "template", o.cfg.Template, "")
+	fs.StringVar(&o.cfg.Prefix, "prefix", o.cfg.Prefix, "")
+	fs.StringVar(&o.cfg.BaseURL, "base-url", o.cfg.BaseURL, "")
+	fs.StringVar(&o.cfg.IndexFile, "index", o.cfg.IndexFile, "")
+
+	fs.Func("allow", "", func(v string) error {
+		n, err := parseNet(v)
+		if err == nil {
+			if o.replaceList("allow") {
+				o.allow = nil
+			}
+			o.allow = append(o.allow, n)
+		}
+		return err
+	})
+	fs.Func("trust-proxy", "", func(v string) error {
+		n, err := parseNet(v)
+		if err == nil {
+			if o.replaceList("trust-proxy") {
+				o.trust = nil
+			}
+			o.trust = append(o.trust, n)
+		}
+		return err
+	})
+	fs.Func("ext", "", func(v string) error {
+		if o.replaceList("ext") {
+			o.cfg.Extensions = nil
+		}
+		o.cfg.Extensions = append(o.cfg.Extensions, parseExtensions(v)...)
+		return nil
+	})
+	fs.Func("no-ext", "", func(v string) error {
+		if o.replaceList("no-ext") {
+			o.cfg.NoExtensions = nil
+		}
+		o.cfg.NoExtensions = append(o.cfg.NoExtensions, parseExtensions(v)...)
+		return nil
+	})
+	fs.Func("mime", "", func(v string) error {
+		ext, mimet, err := parseMimeType(v)
+		if err == nil {
+			if o.replaceList("mime") {
+				o.cfg.MimeTypes = make(map[string]string)
+			}
+			o.cfg.MimeTypes[ext] = mimet
+		}
+		return err
+	})
+	fs.Func("depth", "", func(v string) (err error) {
+		o.cfg.MaxDepth, err = parseCount(v, 0)
+		return err
+	})
+	fs.Func("max-conn", "", func(v string) (err error) {
+		o.cfg.MaxTransfers, err = parseCount(v, 1)
+		return err
+	})
+	fs.Func("bwlimit", "", func(v string) (err error) {
+		if o.cfg.BandwidthLimit, err = parseSize(v); err == nil && o.cfg.BandwidthLimit < 1 {
+			err = errors.New("must be positive")
+		}
+		return err
+	})
+	fs.Func("max-size", "", func(v string) (err error) {
+		o.cfg.MaxSize, err = parseSize(v)
+		return err
+	})
+	fs.Func("timeout", "", func(v string) (err error) {
+		if o.wait, err = time.ParseDuration(v); err == nil && o.wait <= 0 {
+			err = errors.New("must be positive")
+		}
+		return err
+	})
+	fs.Func("ttl", "", func(v string) (err error) {
+		if o.ttl, err = time.ParseDuration(v); err == nil && o.ttl <= 0 {
+			err = errors.New("must be positive")
+		}
+		return err
+	})
+	fs.Func("rate", "", func(v string) (err error) {
+		if o.rate, err = strconv.ParseFloat(v, 64); err == nil && o.rate <= 0 {
+			err = errors.New("must be positive")
+		}
+		return err
+	})
+	fs.Func("log-format", "", func(v string) error {
+		switch v {
+		case "default", "common", "combined", "json":
+			o.logf = v
+			return nil
+		}
+		return errors.New("must be 'default', 'common', 'combined' or 'json'")
+	})
+	fs.BoolFunc("log-json", "", func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if b {
+			o.logf = "json"
+		}
+		return err
+	})
+
+	fs.Var(&o.cors, "cors", "")
+	fs.StringVar(&o.logp, "logfile", o.logp, "")
+	fs.BoolVar(&o.logtee, "log-stderr", o.logtee, "")
+	fs.BoolFunc("quiet", "", func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if b {
+			o.verbosity = sharedir.LogQuiet
+		}
+		return err
+	})
+	fs.BoolFunc("v", "", func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if b {
+			o.verbosity = sharedir.LogDebug
+		}
+		return err
+	})
+	fs.StringVar(&o.addr, "a", o.addr, "")
+	fs.StringVar(&o.cert, "cert", o.cert, "")
+	fs.StringVar(&o.key, "key", o.key, "")
+	fs.BoolVar(&o.selfsign, "tls", o.selfsign, "")
+	fs.BoolVar(&o.http2, "http2", o.http2, "")
+	fs.BoolVar(&o.autoPort, "auto-port", o.autoPort, "")
+	fs.BoolVar(&o.qr, "qr", o.qr, "")
+	fs.BoolVar(&o.open, "open", o.open, "")
+	fs.Func("mdns", "", func(v string) error {
+		if !validLabel(v) {
+			return errors.New("must consist of letters, digits and '-'")
+		}
+		o.mdns = v
+		return nil
+	})
+	fs.StringVar(&o.user, "user", o.user, "")
+	fs.StringVar(&o.pass, "pass", o.pass, "")
+	fs.StringVar(&o.config, "config", o.config, "")
+	fs.BoolVar(&o.version, "version", o.version, "")
+	fs.BoolVar(&o.dryRun, "dry-run", o.dryRun, "")
+
+	return fs
+}
+
+// Parse args with fs and return the directories. Unlike with
+// plain fs.Parse, directories and options can be mixed. All
+// arguments after '--' are directories, even if they start
+// with a dash.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var dirs []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return dirs, nil
+		}
+
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(dirs, rest...), nil
+		}
+
+		dirs = append(dirs, rest[0])
+		args = rest[1:]
+	}
+}
+
+// Check if name can be used as a DNS label (of a host name).
+func validLabel(name string) bool {
+	if name == "" || len(name) > 63 || strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCount(v string, least int) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	if n < least {
+		return 0, errors.New("number too small")
+	}
+	return n, nil
+}
+
+// Parse comma-separated list of extensions, with or without
+// leading dot, e.g. "jpg,.PNG".
+func parseExtensions(list string) []string {
+	var exts []string
+
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			exts = append(exts, "."+strings.ToLower(strings.TrimPrefix(e, ".")))
+		}
+	}
+	return exts
+}
+
+// Parse MIME-type mapping "ext=type", e.g. "md=text/plain".
+// The extension may have a leading dot.
+func parseMimeType(s string) (string, string, error) {
+	ext, mimet, ok := strings.Cut(s, "=")
+	ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+	if !ok || ext == "" {
+		return "", "", fmt.Errorf("expected EXT=TYPE, got '%s'", s)
+	}
+
+	if _, _, err := mime.ParseMediaType(mimet); err != nil {
+		return "", "", fmt.Errorf("type '%s': %v", mimet, err)
+	}
+	return "." + ext, mimet, nil
+}
+
+// Parse size in bytes with optional binary unit suffix, e.g.
+// "512K" or "10M".
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * mult, nil
+}
+
+// Parse network in CIDR notation, a single IP address is
+// treated as a network of its own.
+func parseNet(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// Value of the -cors option, which can be given without value
+// to allow any origin.
+type corsOrigin string
+
+func (c *corsOrigin) String() string {
+	return string(*c)
+}
+
+func (c *corsOrigin) Set(v string) error {
+	switch v {
+	case "true":
+		*c = "*"
+	case "false":
+		*c = ""
+	default:
+		if v != "*" && !strings.HasPrefix(v, "http://") && !strings.HasPrefix(v, "https://") {
+			return errors.New("must be '*' or an origin like 'https://example.com'")
+		}
+		*c = corsOrigin(strings.TrimSuffix(v, "/"))
+	}
+	return nil
+}
+
+func (c *corsOrigin) IsBoolFlag() bool {
+	return true
+}
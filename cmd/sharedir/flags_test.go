@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestParseNet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // empty if invalid
+	}{
+		{"192.168.1.0/24", "192.168.1.0/24"},
+		{"192.168.1.7/24", "192.168.1.0/24"},
+		{"10.0.0.1", "10.0.0.1/32"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"::1", "::1/128"},
+		{"192.168.1.0/33", ""},
+		{"example.com", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		n, err := parseNet(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: accepted as %s", tt.in, n)
+			}
+			continue
+		}
+		if err != nil || n.String() != tt.want {
+			t.Errorf("%q: %v, %v, want %s", tt.in, n, err, tt.want)
+		}
+	}
+}
+
+func TestParseMimeType(t *testing.T) {
+	tests := []struct {
+		in   string
+		ext  string // empty if invalid
+		mime string
+	}{
+		{"md=text/plain", ".md", "text/plain"},
+		{".LOG=text/plain; charset=utf-8", ".log", "text/plain; charset=utf-8"},
+		{" go =text/x-go", ".go", "text/x-go"},
+		{"md", "", ""},
+		{"=text/plain", "", ""},
+		{"md=", "", ""},
+		{"md=not a type", "", ""},
+	}
+
+	for _, tt := range tests {
+		ext, mimet, err := parseMimeType(tt.in)
+		if tt.ext == "" {
+			if err == nil {
+				t.Errorf("%q: accepted as %s=%s", tt.in, ext, mimet)
+			}
+			continue
+		}
+		if err != nil || ext != tt.ext || mimet != tt.mime {
+			t.Errorf("%q: %s=%s, %v", tt.in, ext, mimet, err)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args      []string
+		dirs      []string
+		recursive bool
+		addr      string
+	}{
+		{nil, nil, false, ":2022"},
+		{[]string{"dir"}, []string{"dir"}, false, ":2022"},
+		{[]string{"-r", "dir"}, []string{"dir"}, true, ":2022"},
+		{[]string{"dir", "-r"}, []string{"dir"}, true, ":2022"},
+		{[]string{"a", "-r", "b", "-a", ":8080"}, []string{"a", "b"}, true, ":8080"},
+		{[]string{"--r", "-a=:8080", "dir"}, []string{"dir"}, true, ":8080"},
+		{[]string{"--a", ":8080", "dir"}, []string{"dir"}, false, ":8080"},
+		{[]string{"-r=false", "dir"}, []string{"dir"}, false, ":2022"},
+		{[]string{"-r", "--", "-r", "-dir"}, []string{"-r", "-dir"}, true, ":2022"},
+		{[]string{"a", "--", "-a", ":8080"}, []string{"a", "-a", ":8080"}, false, ":2022"},
+	}
+
+	for _, tt := range tests {
+		o := defaultOptions()
+		dirs, err := parseArgs(newFlagSet(&o), tt.args)
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if !slices.Equal(dirs, tt.dirs) || o.cfg.Recursive != tt.recursive || o.addr != tt.addr {
+			t.Errorf("%q: dirs %q, recursive %t, addr %q", tt.args, dirs, o.cfg.Recursive, o.addr)
+		}
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"-bogus", "dir"},
+		{"dir", "-bogus"},
+		{"-a"},
+		{"-r=maybe"},
+		{"-max-conn", "many"},
+	} {
+		o := defaultOptions()
+		fs := newFlagSet(&o)
+		fs.SetOutput(io.Discard)
+		if _, err := parseArgs(fs, args); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
+
+func TestCORSOption(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string // empty if invalid or not given
+	}{
+		{nil, ""},
+		{[]string{"-cors"}, "*"},
+		{[]string{"-cors=*"}, "*"},
+		{[]string{"-cors=https://app.example.com/"}, "https://app.example.com"},
+		{[]string{"-cors=false"}, ""},
+		{[]string{"-cors=app.example.com"}, ""},
+	}
+
+	for _, tt := range tests {
+		o := defaultOptions()
+		fs := newFlagSet(&o)
+		fs.SetOutput(io.Discard)
+		parseArgs(fs, tt.args)
+		if string(o.cors) != tt.want {
+			t.Errorf("%q: %q, want %q", tt.args, o.cors, tt.want)
+		}
+	}
+}
+
+func TestLogFormatOption(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string // empty if invalid
+	}{
+		{nil, "default"},
+		{[]string{"-log-json"}, "json"},
+		{[]string{"-log-format", "combined"}, "combined"},
+		{[]string{"-log-format", "common", "-log-json"}, "json"},
+		{[]string{"-log-format", "apache"}, ""},
+	}
+
+	for _, tt := range tests {
+		o := defaultOptions()
+		fs := newFlagSet(&o)
+		fs.SetOutput(io.Discard)
+		_, err := parseArgs(fs, tt.args)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q accepted", tt.args)
+			}
+			continue
+		}
+		if err != nil || o.logf != tt.want {
+			t.Errorf("%q: %q, %v, want %q", tt.args, o.logf, err, tt.want)
+		}
+	}
+}
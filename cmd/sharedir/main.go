@@ -0,0 +1,716 @@
+// Command sharedir quickly and safely shares directories over HTTP.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vgratian/sharedir"
+)
+
+const (
+	shutdownTimeout = 30 * time.Second // wait for transfers on shutdown
+	headerTimeout   = 10 * time.Second // max time to read request headers
+
+	exitAddrInUse = 3  // exit code if the address is already in use
+	autoPorts     = 10 // ports tried after the given one with -auto-port
+)
+
+const usage = `Quickly and safely share content of a directory over HTTP.
+
+Usage: sharedir [options] [[name=]directory...]
+
+Options and arguments:
+    -r          Recursive mode (also share subdirectories)
+    -ext LIST   Only share files with these extensions (comma-separated,
+                e.g. 'jpg,png,mp4')
+    -no-ext LIST
+                Don't share files with these extensions (comma-separated)
+    -index NAME Serve this file instead of the listing of directories
+                containing it (default: 'index.html'), unless '?list=1'
+                is requested. Use '' to always show listings
+    -mime EXT=TYPE
+                Serve files with this extension as this MIME-type (e.g.
+                'md=text/plain'), can be given several times. Otherwise
+                the type is looked up in a built-in table of source code
+                extensions (e.g. .md is text/markdown, .go text/plain),
+                then in the system table, then detected from the content
+                and else application/octet-stream
+    -ci         If a file or directory isn't found, look for one whose name
+                only differs in case (e.g. 'README.md' for 'Readme.md').
+                Only the last component of the path is matched
+    -depth N    In recursive mode, share only N levels of subdirectories
+    -A          Also share hidden files and directories (dotfiles)
+    -follow-symlinks
+                Follow symbolic links, as long as they point inside
+                the shared directory (by default they are refused)
+    -upload     Allow clients to upload files into shared directories,
+                existing files are only replaced with '?overwrite=1'.
+                Large files can be sent with PUT in chunks and resumed
+                after interruptions (see README)
+    -webdav     Allow mounting shared directories as a (read-only)
+                network drive over WebDAV at '/dav/' (which hides
+                an entry named 'dav' at the top of the share)
+    -markdown   Render Markdown (.md) files as HTML pages in browsers,
+                the source is available with '?raw=1'
+    -preview    Show text and source code files as HTML pages with line
+                numbers in browsers, the source is available with '?raw=1'
+    -thumbnails Show thumbnails of images (jpg, png, gif) in listings
+    -once       Share a single file (given instead of a directory) for
+                one download: once it was downloaded completely, the
+                server shuts down. Ranges of it are not served
+    -no-listing Don't list directories (403), files are only served to
+                clients that know their path. Search, download statistics,
+                zip archives, thumbnails and WebDAV listings are disabled
+                as well
+    -secret KEY Link files in listings with signed URLs under '/~get', which
+                can't be guessed or changed to other files. They work
+                without '-user' and '-pass', so they can be shared
+    -secret-ttl DURATION
+                Signed links expire after this time (e.g. '24h'), by
+                default they are valid as long as the key is the same
+    -signed-only
+                Serve files only via signed links (403 otherwise, also for
+                index files, zip archives and thumbnails), listings are
+                still shown to create them
+    -manifest   List all shared files (of subdirectories too with '-r') as
+                JSON at '/~manifest', with path, size, modification time
+                and MIME-type, e.g. for tools that mirror the share
+    -live       Reload listings in browsers when entries of the directory
+                change (e.g. of build outputs), with JavaScript. Directories
+                are watched for changes (e.g. with inotify) while listings
+                are open
+    -cache-listings
+                Keep rendered listings in memory until entries of the
+                directory are added, removed or renamed. Faster for large
+                directories, but changed sizes of files are not shown
+    -template FILE
+                Render directory listings with this template instead of
+                the built-in one (see README for available fields)
+    -prefix PATH
+                Serve under this URL path (e.g. '/share'), for running
+                behind a reverse proxy that doesn't strip it
+    -base-url URL
+                Public URL of the share (e.g. 'https://files.example.com/share'),
+                used for absolute links, the startup log and the QR code.
+                Without it, X-Forwarded-Proto and X-Forwarded-Host are used
+    -timeout DURATION
+                Time allowed to read a request and to keep idle connections
+                open (default: 1m). Downloads are not limited, uploads are
+                allowed to take longer than that (e.g. '30s', '5m')
+    -ttl DURATION
+                Stop the server after this time (e.g. '30m', '2h'), giving
+                active transfers up to 30s to finish
+    -max-size SIZE
+                Don't share files larger than SIZE bytes, optionally with
+                unit K, M or G (e.g. '100M'). They are hidden in listings
+                and requests for them are answered with 413
+    -max-conn N Serve at most N file downloads (including zip archives)
+                at the same time, further ones are answered with 503
+    -bwlimit RATE
+                Limit each download to RATE bytes per second, optionally
+                with unit K, M or G (e.g. '500K')
+    -rate N     Limit each client (IP address) to N requests per second,
+                exceeding requests are answered with 429
+    -allow CIDR Only allow clients from this network (e.g. 192.168.1.0/24)
+                or IP address, can be given several times
+    -trust-proxy CIDR
+                Take client addresses from X-Forwarded-For or X-Real-IP of
+                requests from proxies in this network or at this IP address,
+                for logs, -rate and -allow, and build links (e.g. of
+                -manifest) from their X-Forwarded-Proto and X-Forwarded-Host.
+                Can be given several times
+    -cors[=ORIGIN]
+                Allow cross-origin requests (CORS) from ORIGIN (e.g.
+                'https://example.com'), or from any origin if not given
+    -qr         Print a QR code of the link to the share at startup
+    -mdns NAME  Announce the share on the local network via mDNS, so that
+                it can be reached as 'http(s)://NAME.local:PORT' (not resolved
+                by all systems, e.g. Android)
+    -open       Open the share in the default browser at startup
+    -log-format FORMAT
+                Log requests in this format: 'default', 'common' (Common
+                Log Format, as Apache), 'combined' (also referer and
+                user agent) or 'json' (see '-log-json'). Other messages
+                about requests are then only logged with '-v'
+    -log-json   Log requests as JSON objects, one per line, with timestamp,
+                request_id, method, remote_ip, path, status, bytes and
+                duration_ms. The ID is sent back in the 'X-Request-ID'
+                header (one set by a proxy is kept)
+    -logfile FILE
+                Append logs to this file instead of writing them to the
+                terminal (stderr)
+    -log-stderr With '-logfile', write logs to stderr as well
+    -quiet      Log only startup messages and errors
+    -v          Verbose mode, additionally to requests, log details
+                like resolved paths
+    -a ADDR     Start HTTP server on this address (default: ':2022'),
+                exits with status 3 if it is already in use
+    -auto-port  If the port of '-a' is in use, try the next 10 ports and
+                then any free port, the one used is logged
+    -http2      Also serve HTTP/2 without TLS (h2c, with prior knowledge),
+                with TLS it is always available
+    -cert FILE  Serve HTTPS using this certificate (PEM), requires '-key'
+    -key FILE   Private key (PEM) of the certificate, requires '-cert'
+    -tls        Serve HTTPS using a self-signed certificate generated
+                at startup (unless '-cert' and '-key' are given)
+    -user NAME  Require HTTP basic authentication with this username,
+                requires '-pass'
+    -pass PASSWORD
+                Password for HTTP basic authentication, requires '-user'
+    -config FILE
+                Read options from this file, one 'key = value' per line.
+                Keys are the option names without dash (or 'recursive',
+                'hidden', 'addr', 'verbose' and 'root' for directories),
+                options on the command line take precedence
+    -dry-run    Check the configuration (directories, template, address,
+                certificate), print what would be shared and exit
+    -version    Print the version and exit
+    directory   Directory to share (default: current directory), if
+                several are given, each is shared under its base name,
+                or under NAME if given as 'NAME=PATH'. Paths matching the
+                patterns in its '.sharedirignore' file (as in .gitignore)
+                are not shared. Directories containing a '.sharedir-auth'
+                file (lines of 'user:password') require these credentials
+                for themselves and their subdirectories
+	
+Options take a value as '-name value' or '-name=value', '--name' works as
+well. Arguments after '--' are directories, even if they start with '-'.
+
+Options can also be set with environment variables, named SHAREDIR_ and
+the config file key in upper case with '_' for '-' (e.g. SHAREDIR_ADDR,
+SHAREDIR_RECURSIVE=true, SHAREDIR_MAX_CONN). SHAREDIR_ROOT lists
+directories separated by ':' (';' on Windows). Command-line options take
+precedence over environment variables, which take precedence over the
+config file. Values of options that can be given several times (-allow,
+-trust-proxy, -ext, -no-ext and -mime) add up within one of these, but
+replace those of the others: e.g. '-ext pdf' on the command line shares
+only PDF files, whatever extensions the config file lists.
+
+Report bugs: https://github.com/vgratian/sharedir
+`
+
+// Wait for SIGINT or SIGTERM, for served to be closed or for the
+// share to expire, and shut down the server, giving active
+// transfers time to finish. Closes done when finished.
+func shutdownOnSignal(srv *http.Server, served <-chan struct{}, expired <-chan time.Time, done chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case s := <-sig:
+		// a second signal kills the process right away
+		signal.Stop(sig)
+		log.Printf("received %s, shutting down (waiting up to %s for active transfers)", s, shutdownTimeout)
+	case <-served:
+		signal.Stop(sig)
+		log.Printf("file was downloaded, shutting down")
+	case <-expired:
+		signal.Stop(sig)
+		log.Printf("share expired, shutting down (waiting up to %s for active transfers)", shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	close(done)
+}
+
+// Listen at addr. If its port is in use and auto is set, the
+// next autoPorts ports are tried, and then any free port.
+func listen(addr string, auto bool) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil || !auto || !addrInUse(err) {
+		return ln, err
+	}
+
+	host, p, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(p)
+
+	for i := 1; i <= autoPorts+1; i++ {
+		next := port + i
+		if i > autoPorts || next > 65535 {
+			next = 0
+		}
+
+		a := net.JoinHostPort(host, strconv.Itoa(next))
+		if ln, err = net.Listen("tcp", a); err == nil {
+			log.Printf("port %d is in use, listening at %s instead", port, ln.Addr())
+			return ln, nil
+		}
+		if !addrInUse(err) || next == 0 {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Whether err is due to the address being in use. Windows reports
+// WSAEADDRINUSE, which syscall.EADDRINUSE doesn't match there.
+func addrInUse(err error) bool {
+	if runtime.GOOS == "windows" && errors.Is(err, syscall.Errno(10048)) {
+		return true
+	}
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// URLs under which the server at addr can be reached. If it
+// listens on all interfaces, there is one for each non-loopback
+// IPv4 address of this machine.
+func shareURLs(addr string, https bool) []string {
+	var urls []string
+
+	scheme := "http://"
+	if https {
+		scheme = "https://"
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{scheme + net.JoinHostPort(host, port)}
+	}
+
+	ips, err := localIPv4s()
+	if err != nil {
+		log.Printf("list network interfaces: %v", err)
+		return nil
+	}
+
+	for _, ip := range ips {
+		urls = append(urls, scheme+net.JoinHostPort(ip, port))
+	}
+	return urls
+}
+
+// Non-loopback IPv4 addresses of this machine.
+func localIPv4s() ([]string, error) {
+	var ips []string
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			ips = append(ips, n.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+// URL of the server at addr for the browser on this machine.
+func localURL(addr string, https bool) string {
+	scheme := "http://"
+	if https {
+		scheme = "https://"
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return scheme + addr
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return scheme + net.JoinHostPort(host, port)
+}
+
+// Open url in the default browser, without waiting for it.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// reap the process when the opener exits
+	go cmd.Wait()
+	return nil
+}
+
+// Check that addr is a valid "host:port" address to listen
+// on. The host may be empty (all interfaces), IPv6 addresses
+// must be in brackets.
+func checkAddr(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if _, err := strconv.Atoi(addr); err == nil {
+			return fmt.Errorf("'%s' has no host part, did you mean ':%s'?", addr, addr)
+		}
+		if ip := net.ParseIP(addr); ip != nil {
+			return fmt.Errorf("'%s' has no port, expected e.g. '%s'", addr, net.JoinHostPort(addr, "2022"))
+		}
+		return fmt.Errorf("'%s' is not of the form HOST:PORT (e.g. ':2022', '127.0.0.1:2022' or '[::1]:2022')", addr)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port '%s'", port)
+	}
+
+	if strings.ContainsAny(host, " /[]") {
+		return fmt.Errorf("invalid host '%s'", host)
+	}
+	return nil
+}
+
+// Serve HTTP/2 without TLS (h2c) as well. With TLS, HTTP/2 is
+// negotiated anyway. Without, clients have to know in advance
+// that it is supported (no Upgrade header).
+func enableH2C(srv *http.Server) {
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+}
+
+// Direct the log to the file at path, created if missing and
+// appended to otherwise, and also to stderr if tee.
+func openLog(path string, tee bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if tee {
+		log.SetOutput(io.MultiWriter(f, os.Stderr))
+	} else {
+		log.SetOutput(f)
+	}
+	return f, nil
+}
+
+func main() {
+
+	var (
+		s    *sharedir.Server
+		o    options
+		mux  *http.ServeMux
+		srv  http.Server
+		ln   net.Listener
+		err  error
+		dirs []string
+	)
+
+	if len(os.Args) > 1 && os.Args[1] == "help" {
+		fmt.Print(usage)
+		os.Exit(0)
+	}
+
+	// check the command line and look for the config file first
+	pre := defaultOptions()
+	if dirs, err = parseArgs(newFlagSet(&pre), os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Print(usage)
+			os.Exit(0)
+		}
+		fmt.Println("run 'sharedir -h' for usage")
+		os.Exit(2)
+	}
+
+	if pre.version {
+		fmt.Println("sharedir", sharedir.Version)
+		os.Exit(0)
+	}
+
+	// options from the config file are parsed first and those on
+	// the command line last, so that each overrides the former
+	o = defaultOptions()
+	flags := newFlagSet(&o)
+
+	var confDirs, envDirs []string
+
+	if pre.config != "" {
+		o.source = fromConfig
+		if confDirs, err = readConfig(flags, pre.config); err != nil {
+			fmt.Printf("read config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	o.source = fromEnv
+	if envDirs, err = readEnv(flags); err != nil {
+		fmt.Printf("invalid environment variable %v\n", err)
+		os.Exit(1)
+	}
+
+	o.source = fromArgs
+	parseArgs(flags, os.Args[1:])
+	sharedir.SetLogLevel(o.verbosity)
+
+	if err = checkAddr(o.addr); err != nil {
+		fmt.Printf("invalid value for '-a': %v\n", err)
+		os.Exit(1)
+	}
+
+	if (o.cert == "") != (o.key == "") {
+		fmt.Println("options '-cert' and '-key' must be used together")
+		os.Exit(1)
+	}
+
+	if (o.user == "") != (o.pass == "") {
+		fmt.Println("options '-user' and '-pass' must be used together")
+		os.Exit(1)
+	}
+
+	if o.logp != "" {
+		f, err := openLog(o.logp, o.logtee)
+		if err != nil {
+			fmt.Printf("open log file: %v\n", err)
+			os.Exit(1)
+		}
+		// writes are not buffered, closing is enough after shutdown
+		defer f.Close()
+	}
+
+	if len(dirs) == 0 {
+		dirs = envDirs
+	}
+	if len(dirs) == 0 {
+		dirs = confDirs
+	}
+	if len(dirs) > 0 {
+		o.cfg.Dirs = dirs
+	}
+
+	if o.cfg.Once {
+		inf, err := os.Stat(o.cfg.Dirs[0])
+		if len(o.cfg.Dirs) != 1 || err != nil || !inf.Mode().IsRegular() {
+			fmt.Println("option '-once' needs a single file to share")
+			os.Exit(1)
+		}
+		// the other files of its directory are not shared
+		o.cfg.FS = sharedir.FileFS(o.cfg.Dirs[0])
+	}
+
+	// for links to files, which would otherwise point to hosts
+	// given by anyone
+	o.cfg.TrustedProxies = o.trust
+	if s, err = sharedir.NewServer(o.cfg); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, d := range s.Dirs() {
+		if o.cfg.Once {
+			log.Printf("sharing file [%s] for one download", o.cfg.Dirs[0])
+		} else if o.cfg.Recursive {
+			log.Printf("sharing directory [%s] recursively", d.Path)
+		} else {
+			log.Printf("sharing directory [%s]", d.Path)
+		}
+	}
+
+	mux = http.NewServeMux()
+	mux.Handle("/", s)
+	srv.Handler = sharedir.Compress(mux)
+
+	if o.user != "" {
+		log.Printf("requiring authentication as user '%s'", o.user)
+		srv.Handler = sharedir.BasicAuth(srv.Handler, o.user, o.pass, s.IsSigned)
+	}
+
+	if o.cors != "" {
+		log.Printf("allowing cross-origin requests from %s", o.cors)
+		srv.Handler = sharedir.CORS(srv.Handler, string(o.cors))
+	}
+
+	if len(o.allow) > 0 {
+		for _, n := range o.allow {
+			log.Printf("allowing clients from %s", n)
+		}
+		srv.Handler = sharedir.AllowNets(srv.Handler, o.allow)
+	}
+
+	if o.rate > 0 {
+		log.Printf("limiting clients to %g requests per second", o.rate)
+		srv.Handler = sharedir.RateLimit(srv.Handler, o.rate)
+	}
+
+	if o.logf != "default" {
+		// access log replaces the messages about requests
+		if o.logf == "json" {
+			srv.Handler = sharedir.JSONLog(srv.Handler)
+		} else {
+			srv.Handler = sharedir.AccessLog(srv.Handler, o.logf == "combined")
+		}
+		if o.verbosity == sharedir.LogInfo {
+			sharedir.SetLogLevel(sharedir.LogQuiet)
+		}
+	}
+
+	// outermost, everything else sees the client behind the proxy
+	if len(o.trust) > 0 {
+		for _, n := range o.trust {
+			log.Printf("trusting forwarded client addresses from %s", n)
+		}
+		srv.Handler = sharedir.TrustProxy(srv.Handler, o.trust)
+	}
+
+	srv.Addr = o.addr
+
+	// protect against clients holding connections open forever. There
+	// is no write timeout, since it limits the whole response, i.e. it
+	// would cut off downloads of large files on slow connections.
+	srv.ReadHeaderTimeout = min(o.wait, headerTimeout)
+	srv.ReadTimeout = o.wait
+	srv.IdleTimeout = o.wait
+
+	if o.http2 {
+		enableH2C(&srv)
+	}
+
+	if o.cert == "" && o.selfsign {
+		var c tls.Certificate
+
+		if c, err = selfSignedCert(); err != nil {
+			fmt.Printf("generate certificate: %v\n", err)
+			os.Exit(1)
+		}
+
+		log.Printf("generated self-signed certificate [SHA-256 %s]", fingerprint(c))
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{c}}
+	}
+
+	// listen explicitly, so that we know the port if it was ":0"
+	if ln, err = listen(srv.Addr, o.autoPort); err != nil {
+		if addrInUse(err) {
+			fmt.Printf("address %s is already in use, e.g. by another instance,\n", srv.Addr)
+			fmt.Printf("choose another one with '-a' (e.g. '-a :2023', or '-a :0' for any free port)\n")
+			fmt.Printf("or let '-auto-port' find a free one\n")
+			os.Exit(exitAddrInUse)
+		}
+		log.Fatalf("starting HTTP service: %s", err.Error())
+	}
+
+	// the address we listen at is likely not reachable behind a proxy
+	var urls []string
+	if s.BaseURL() != "" {
+		urls = []string{s.BaseURL()}
+	} else {
+		urls = shareURLs(ln.Addr().String(), o.cert != "" || o.selfsign)
+		for i := range urls {
+			urls[i] += s.Prefix()
+		}
+	}
+	for i := range urls {
+		if o.cfg.Once {
+			urls[i] += "/" + url.PathEscape(filepath.Base(o.cfg.Dirs[0]))
+		}
+		log.Printf("share this link: %s", urls[i])
+	}
+
+	// everything is set up, check what is otherwise only noticed
+	// when serving
+	if o.dryRun {
+		ln.Close()
+
+		if err = s.Check(); err != nil {
+			fmt.Printf("can't read directory: %v\n", err)
+			os.Exit(1)
+		}
+		if dirs := s.Dirs(); len(dirs) > 1 {
+			for _, d := range dirs {
+				log.Printf("[%s] is shared at %s/%s/", d.Path, s.Prefix(), d.Name)
+			}
+		}
+
+		if o.cert != "" {
+			if _, err = tls.LoadX509KeyPair(o.cert, o.key); err != nil {
+				fmt.Printf("load certificate: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		log.Print("dry run: configuration is valid, not serving")
+		return
+	}
+
+	if o.qr && len(urls) > 0 {
+		if code, err := qrEncode([]byte(urls[0])); err != nil {
+			log.Printf("QR code: %v", err)
+		} else {
+			fmt.Print(code)
+		}
+	}
+
+	if o.mdns != "" {
+		if m, err := startMDNS(o.mdns, ln.Addr().String(), s.Prefix(), o.cert != "" || o.selfsign); err != nil {
+			log.Printf("mDNS: %v", err)
+		} else {
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			u := localURL(net.JoinHostPort(o.mdns+".local", port), o.cert != "" || o.selfsign)
+			// e.g. Android and Windows without Bonjour don't resolve .local
+			log.Printf("announcing %s via mDNS (not all systems resolve it)", u+s.Prefix())
+			defer m.Shutdown()
+		}
+	}
+
+	// the listener already accepts connections, so the page loads
+	if o.open {
+		u := localURL(ln.Addr().String(), o.cert != "" || o.selfsign) + s.Prefix()
+		if err := openBrowser(u); err != nil {
+			log.Printf("can't open browser: %v", err)
+		}
+	}
+
+	// event streams would hold up the shutdown until it times out
+	srv.RegisterOnShutdown(s.Close)
+
+	done := make(chan struct{})
+	// nil if the share doesn't expire, i.e. never fires
+	var expired <-chan time.Time
+	if o.ttl > 0 {
+		log.Printf("share expires in %s", o.ttl)
+		expired = time.After(o.ttl)
+	}
+	go shutdownOnSignal(&srv, s.Served(), expired, done)
+
+	if o.cert != "" || o.selfsign {
+		log.Printf("serving at %s (HTTPS)", ln.Addr())
+		err = srv.ServeTLS(ln, o.cert, o.key)
+	} else {
+		log.Printf("serving at %s", ln.Addr())
+		err = srv.Serve(ln)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("starting HTTP service: %s", err.Error())
+	}
+
+	<-done
+	log.Print("shutdown complete")
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vgratian/sharedir"
+)
+
+// With port 0 the system chooses one, the listener tells which.
+func TestListenPort0(t *testing.T) {
+	ln, err := listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	_, p, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, err := strconv.Atoi(p); err != nil || port == 0 {
+		t.Fatalf("port %q", p)
+	}
+
+	if u := localURL(ln.Addr().String(), false); u != "http://127.0.0.1:"+p {
+		t.Errorf("local URL %q", u)
+	}
+	if urls := shareURLs(ln.Addr().String(), true); len(urls) != 1 || !strings.HasSuffix(urls[0], ":"+p) {
+		t.Errorf("share URLs %q", urls)
+	}
+}
+
+func TestOpenLog(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+
+	fp := filepath.Join(t.TempDir(), "sharedir.log")
+	if err := os.WriteFile(fp, []byte("earlier\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openLog(fp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Print("logged")
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "earlier\n") || !strings.HasSuffix(string(b), "logged\n") {
+		t.Errorf("log file contains %q", b)
+	}
+
+	if _, err = openLog(filepath.Join(t.TempDir(), "missing", "sharedir.log"), false); err == nil {
+		t.Error("opened log file in missing directory")
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{":2022", true},
+		{"127.0.0.1:2022", true},
+		{"[::1]:2022", true},
+		{"localhost:8080", true},
+		{":0", true},
+		{"2022", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::1:2022", false},
+		{":http", false},
+		{":70000", false},
+		{"[::1:2022", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkAddr(tt.addr); (err == nil) != tt.valid {
+			t.Errorf("%q: %v", tt.addr, err)
+		}
+	}
+
+	// hints for common mistakes
+	if err := checkAddr("2022"); err == nil || !strings.Contains(err.Error(), "':2022'") {
+		t.Errorf("no hint for missing colon: %v", err)
+	}
+}
+
+// Run main with args in a new process of the test binary, and
+// return its output and exit code.
+func runMain(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestMainProcess$", "--"}, args...)...)
+	cmd.Env = append(os.Environ(), "SHAREDIR_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return string(out), ee.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// Not a test, runs main in the process started by runMain.
+func TestMainProcess(t *testing.T) {
+	if os.Getenv("SHAREDIR_TEST_MAIN") == "" {
+		t.Skip("only run by runMain")
+	}
+	os.Args = append([]string{"sharedir"}, flag.Args()...)
+	main()
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		want string // in the output
+	}{
+		{"valid", []string{"-dry-run", "-a", "127.0.0.1:0", dir}, 0, "configuration is valid"},
+		{"missing directory", []string{"-dry-run", "-a", "127.0.0.1:0", filepath.Join(dir, "missing")}, 1, "no such file"},
+		{"invalid address", []string{"-dry-run", "-a", "2022", dir}, 1, "invalid value for '-a'"},
+		{"missing certificate", []string{"-dry-run", "-a", "127.0.0.1:0", "-cert", filepath.Join(dir, "c.pem"), "-key", filepath.Join(dir, "k.pem"), dir}, 1, "load certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, code := runMain(t, tt.args...)
+			if code != tt.code || !strings.Contains(out, tt.want) {
+				t.Errorf("exit code %d, output %q", code, out)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	ts := httptest.NewUnstartedServer(h)
+	enableH2C(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		h2c  bool
+		want string
+	}{
+		{"HTTP/2 client", true, "HTTP/2.0"},
+		{"HTTP/1 client", false, "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		tr := &http.Transport{Protocols: new(http.Protocols)}
+		if tt.h2c {
+			tr.Protocols.SetUnencryptedHTTP2(true)
+		} else {
+			tr.Protocols.SetHTTP1(true)
+		}
+		defer tr.CloseIdleConnections()
+
+		res, err := (&http.Client{Transport: tr}).Get(ts.URL)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(b) != tt.want {
+			t.Errorf("%s: served with %s", tt.name, b)
+		}
+	}
+}
+
+// Serve h at a free port until shutdownOnSignal shuts it down,
+// and return the address and a channel closed after shutdown.
+func serveShutdown(t *testing.T, h http.Handler, served <-chan struct{}, expired <-chan time.Time) (string, <-chan error) {
+	t.Helper()
+
+	ln, err := listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	stopped := make(chan error, 1)
+	go func() { stopped <- srv.Serve(ln) }()
+
+	done := make(chan struct{})
+	go shutdownOnSignal(srv, served, expired, done)
+
+	result := make(chan error, 1)
+	go func() {
+		<-done
+		result <- <-stopped
+	}()
+	return ln.Addr().String(), result
+}
+
+// Wait for the server of serveShutdown to be shut down.
+func waitShutdown(t *testing.T, done <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		if err != http.ErrServerClosed {
+			t.Errorf("serve: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not shut down")
+	}
+}
+
+// In one-shot mode the server stops after the first download.
+func TestOnceShutdown(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(fp, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := sharedir.DefaultConfig()
+	cfg.Once = true
+	cfg.FS = sharedir.FileFS(fp)
+	s, err := sharedir.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, done := serveShutdown(t, s, s.Served(), nil)
+
+	url := "http://" + addr + "/file.txt"
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(b) != "content" {
+		t.Fatalf("status %d, body %q", res.StatusCode, b)
+	}
+
+	waitShutdown(t, done)
+	if _, err := http.Get(url); err == nil {
+		t.Error("still serving")
+	}
+}
+
+// The server stops when the share expires, transfers in progress
+// are finished first.
+func TestTTL(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "content")
+	})
+	addr, done := serveShutdown(t, h, nil, time.After(50*time.Millisecond))
+
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(b) != "content" {
+		t.Errorf("transfer: status %d, body %q", res.StatusCode, b)
+	}
+
+	waitShutdown(t, done)
+	if _, err := http.Get("http://" + addr + "/"); err == nil {
+		t.Error("still serving")
+	}
+}
+
+func TestBaseURLOption(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		base string
+		code int
+		want string
+	}{
+		{"https://files.example.com/share/", 0, "share this link: https://files.example.com/share\n"},
+		{"files.example.com", 1, "base URL"},
+	}
+
+	for _, tt := range tests {
+		out, code := runMain(t, "-dry-run", "-a", "127.0.0.1:0", "-base-url", tt.base, dir)
+		if code != tt.code || !strings.Contains(out, tt.want) {
+			t.Errorf("%s: exit code %d, output %q", tt.base, code, out)
+		}
+	}
+}
+
+// A second instance at the same address fails with a hint what to
+// do about it, and exit code exitAddrInUse.
+func TestAddrInUse(t *testing.T) {
+	ln, err := listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, err := listen(ln.Addr().String(), false); !addrInUse(err) {
+		t.Fatalf("listen: %v", err)
+	}
+
+	out, code := runMain(t, "-dry-run", "-a", ln.Addr().String(), t.TempDir())
+	if code != exitAddrInUse || !strings.Contains(out, "address "+ln.Addr().String()+" is already in use") || !strings.Contains(out, "'-a'") {
+		t.Errorf("exit code %d, output %q", code, out)
+	}
+}
+
+// Errors of bind as reported on Windows are recognized there.
+func TestAddrInUseWindows(t *testing.T) {
+	err := &net.OpError{Op: "listen", Net: "tcp", Err: os.NewSyscallError("bind", syscall.Errno(10048))}
+	if got, want := addrInUse(err), runtime.GOOS == "windows"; got != want {
+		t.Errorf("WSAEADDRINUSE: %v, want %v", got, want)
+	}
+	if addrInUse(errors.New("address already in use")) {
+		t.Errorf("plain error recognized")
+	}
+}
+
+// With auto set, listen falls back to a free port if the one
+// given is in use.
+func TestListenAutoPort(t *testing.T) {
+	busy, err := listen("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	ln, err := listen(busy.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// usually the next port, unless that happens to be in use too
+	if got := ln.Addr().(*net.TCPAddr).Port; got == port || got == 0 {
+		t.Errorf("port %d, busy %d", got, port)
+	}
+
+	// the address is only changed if its port is in use
+	if _, err := listen("127.0.0.1:http:x", true); err == nil || addrInUse(err) {
+		t.Errorf("invalid address: %v", err)
+	}
+
+	out, code := runMain(t, "-dry-run", "-auto-port", "-a", busy.Addr().String(), t.TempDir())
+	if code != 0 || !strings.Contains(out, "port "+strconv.Itoa(port)+" is in use, listening at 127.0.0.1:") {
+		t.Errorf("exit code %d, output %q", code, out)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Start announcing the server listening at addr via mDNS as the
+// DNS-SD service 'name._http._tcp.local.' (or '_https._tcp' if it
+// serves https) on the host 'name.local', with links to path, so
+// that it can be found by name on the local network. Only IPv4
+// addresses are announced. Shutdown withdraws the announcement.
+func startMDNS(name, addr, path string, https bool) (*zeroconf.Server, error) {
+	var ips []string
+
+	service := "_http._tcp"
+	if https {
+		service = "_https._tcp"
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = []string{ip.String()}
+	} else if ips, err = localIPv4s(); err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no IPv4 address to announce")
+	}
+
+	return zeroconf.RegisterProxy(name, service, "local.", p, name, ips, []string{"path=" + path + "/"}, nil)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Minimal QR code encoder, enough to print the URL of the
+// share to the terminal: byte mode, error correction level L,
+// versions 1 to 10 (up to 271 bytes).
+// See ISO/IEC 18004 for the details of each step.
+
+// Codewords of a version at level L: total count, count of
+// error correction codewords per block and number of blocks.
+var qrVersions = [...]struct{ total, ecc, blocks int }{
+	{26, 7, 1}, {44, 10, 1}, {70, 15, 1}, {100, 20, 1}, {134, 26, 1},
+	{172, 18, 2}, {196, 20, 2}, {242, 24, 2}, {292, 30, 2}, {346, 18, 4},
+}
+
+// Centers of alignment patterns of each version.
+var qrAlignment = [...][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30},
+	{6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+type qrCode struct {
+	size     int
+	modules  [][]bool // true if dark, indexed by [y][x]
+	function [][]bool // true if part of a function pattern
+}
+
+// Encode data into a QR code with the smallest version that
+// fits it.
+func qrEncode(data []byte) (*qrCode, error) {
+	var (
+		version int
+		bits    []bool
+	)
+
+	for version = 1; version <= len(qrVersions); version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		capacity := 8 * (qrVersions[version-1].total - qrVersions[version-1].ecc*qrVersions[version-1].blocks)
+		if 4+countBits+8*len(data) <= capacity {
+			bits = qrAppendBits(bits, 0x4, 4) // byte mode
+			bits = qrAppendBits(bits, len(data), countBits)
+			for _, b := range data {
+				bits = qrAppendBits(bits, int(b), 8)
+			}
+			break
+		}
+	}
+
+	if version > len(qrVersions) {
+		return nil, errors.New("data too long for QR code")
+	}
+
+	q := &qrCode{size: 17 + 4*version}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords(version, bits))
+
+	// pick the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // XOR again to undo
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+
+	return q, nil
+}
+
+func qrAppendBits(bits []bool, val, n int) []bool {
+	for i := n - 1; i >= 0; i-- {
+		bits = append(bits, (val>>i)&1 == 1)
+	}
+	return bits
+}
+
+// Pad data bits to the capacity of the version, split into
+// blocks, add error correction and interleave the blocks.
+func qrCodewords(version int, bits []bool) []byte {
+	var (
+		v      = qrVersions[version-1]
+		nData  = v.total - v.ecc*v.blocks
+		data   []byte
+		blocks [][]byte
+		result []byte
+	)
+
+	// terminator and padding to full bytes
+	for i := 0; i < 4 && len(bits) < 8*nData; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		data = append(data, b)
+	}
+
+	for pad := byte(0xEC); len(data) < nData; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	// short blocks come first, long ones have one more data codeword
+	short := v.blocks - v.total%v.blocks
+	shortLen := v.total / v.blocks
+	divisor := rsDivisor(v.ecc)
+
+	for i, k := 0, 0; i < v.blocks; i++ {
+		n := shortLen - v.ecc
+		if i >= short {
+			n += 1
+		}
+		block := append([]byte{}, data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(block, divisor)
+		if i < short {
+			block = append(block, 0) // placeholder, skipped below
+		}
+		blocks = append(blocks, append(block, ecc...))
+	}
+
+	for i := range blocks[0] {
+		for j := range blocks {
+			if i != shortLen-v.ecc || j >= short {
+				result = append(result, blocks[j][i])
+			}
+		}
+	}
+
+	return result
+}
+
+// Generator polynomial for Reed-Solomon codes of this degree.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// Error correction codewords of data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// Multiply in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	var z int
+
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := max(abs(dx), abs(dy))
+					q.setFunction(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+
+	pos := qrAlignment[version-1]
+	for i := range pos {
+		for j := range pos {
+			// skip those overlapping finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve format area, drawn after masking
+	q.drawFormat(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+// Draw both copies of the format information (level L and
+// the mask) and the dark module.
+func (q *qrCode) drawFormat(mask int) {
+	data := 1<<3 | mask // level L
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// Place codewords in the zigzag order, two columns at a time
+// from the bottom right.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // upwards
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// Invert data modules according to the mask pattern.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// Penalty score of the current modules, lower is easier to
+// scan.
+func (q *qrCode) penalty() int {
+	var (
+		score int
+		dark  int
+	)
+
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+
+	// runs of the same color, and patterns similar to finders
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+
+			for x := 0; x+11 <= q.size; x++ {
+				var p strings.Builder
+				for k := 0; k < 11; k++ {
+					if at(x+k, y, vertical) {
+						p.WriteByte('1')
+					} else {
+						p.WriteByte('0')
+					}
+				}
+				if s := p.String(); s == "10111010000" || s == "00001011101" {
+					score += 40
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same color
+	for y := 0; y+1 < q.size; y++ {
+		for x := 0; x+1 < q.size; x++ {
+			c := q.modules[y][x]
+			if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+
+	// balance of dark and light modules
+	for y := range q.modules {
+		for _, d := range q.modules[y] {
+			if d {
+				dark++
+			}
+		}
+	}
+	score += 10 * (abs(dark*100/(q.size*q.size)-50) / 5)
+
+	return score
+}
+
+// Render with half blocks, two rows of modules per line and
+// a quiet zone around. Dark modules are blank, so that the
+// code is displayed correctly on terminals with light text on
+// dark background.
+func (q *qrCode) String() string {
+	const quiet = 2
+	var b strings.Builder
+
+	dark := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x >= 0 && x < q.size && y >= 0 && y < q.size && q.modules[y][x]
+	}
+
+	for y := 0; y < q.size+2*quiet; y += 2 {
+		for x := 0; x < q.size+2*quiet; x++ {
+			top, bottom := dark(x, y), dark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString(" ")
+			case top:
+				b.WriteString("▄")
+			case bottom:
+				b.WriteString("▀")
+			default:
+				b.WriteString("█")
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
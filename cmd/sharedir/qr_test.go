@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Known values from ISO/IEC 18004 the encoder is checked against,
+// each code is decoded again by qrDecode below, which doesn't use
+// the drawing functions of the encoder.
+
+// Format information of level L for each mask (Annex C).
+var qrFormatL = [8]int{0x77C4, 0x72F3, 0x7DAA, 0x789D, 0x662F, 0x6318, 0x6C41, 0x6976}
+
+// Version information of versions 7 to 10 (Annex D).
+var qrVersionInfo = map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+
+// Bytes that fit into each version at level L (Table 7).
+var qrCapacity = [...]int{17, 32, 53, 78, 106, 134, 154, 192, 230, 271}
+
+// Centers of alignment patterns of each version (Annex E).
+var qrCenters = map[int][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+func TestQRReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as 1-M, the usual worked example
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQRCodewords(t *testing.T) {
+	// mode 0100, length 5, "hello", terminator and padding
+	want := []byte{0x40, 0x56, 0x86, 0x56, 0xC6, 0xC6, 0xF0, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+
+	bits := qrAppendBits(qrAppendBits(nil, 0x4, 4), 5, 8)
+	for _, b := range []byte("hello") {
+		bits = qrAppendBits(bits, int(b), 8)
+	}
+	got := qrCodewords(1, bits)
+
+	if len(got) != 26 || !bytes.Equal(got[:19], want) {
+		t.Errorf("got %X", got)
+	}
+	if ecc := rsRemainder(want, rsDivisor(7)); !bytes.Equal(got[19:], ecc) {
+		t.Errorf("error correction %X, want %X", got[19:], ecc)
+	}
+}
+
+// The smallest version that fits is chosen, data that doesn't
+// fit into version 10 is refused.
+func TestQRVersion(t *testing.T) {
+	for i, n := range qrCapacity {
+		version := i + 1
+
+		q, err := qrEncode(bytes.Repeat([]byte{'a'}, n))
+		if err != nil || q.size != 17+4*version {
+			t.Errorf("%d bytes: %v, want version %d", n, err, version)
+		}
+
+		q, err = qrEncode(bytes.Repeat([]byte{'a'}, n+1))
+		if version < len(qrCapacity) && (err != nil || q.size != 21+4*version) {
+			t.Errorf("%d bytes: %v, want version %d", n+1, err, version+1)
+		}
+		if version == len(qrCapacity) && err == nil {
+			t.Errorf("%d bytes: no error", n+1)
+		}
+	}
+}
+
+// Codes of all versions decode to the data they were made of.
+func TestQRDecode(t *testing.T) {
+	inputs := []string{"", "a", "http://192.0.2.1:8080/", "http://[2001:db8::1]:8080/s/"}
+	for i, n := range qrCapacity {
+		// odd data, to vary the masks
+		var b strings.Builder
+		for j := 0; j < n; j++ {
+			b.WriteByte(byte(j*(i+7)) | 1)
+		}
+		inputs = append(inputs, b.String())
+	}
+
+	for _, in := range inputs {
+		q, err := qrEncode([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := qrDecode(q.modules); err != nil || got != in {
+			t.Errorf("%d bytes: decoded %d bytes, %v", len(in), len(got), err)
+		}
+	}
+}
+
+// Modules of one of the inputs of TestQRDecode, so that changes
+// of the chosen mask are noticed as well.
+func TestQRModules(t *testing.T) {
+	want := []string{
+		"#######...#..#.##.#######",
+		"#.....#..#...#.#..#.....#",
+		"#.###.#.#..#..###.#.###.#",
+		"#.###.#..#..#...#.#.###.#",
+		"#.###.#..#..#..##.#.###.#",
+		"#.....#...####.##.#.....#",
+		"#######.#.#.#.#.#.#######",
+		"........#..#.#.#.........",
+		"###.#####...###..##...#..",
+		"#.##.#.###.##.#...##....#",
+		".####.###.###.#.#.###.###",
+		"#..#.#.#.##.##..#####..#.",
+		"#.#.#.##..##.####.##.#.##",
+		".##.#....###.##..###.#..#",
+		"#.#...#.#.....#.##.##.###",
+		".#.###...###.#...###.#.#.",
+		"#.#.###.#...###.######...",
+		"........#.###...#...#####",
+		"#######.#.####.##.#.#..##",
+		"#.....#.#.#.#####...##.##",
+		"#.###.#.####..#.#####..##",
+		"#.###.#...##...###..#.#..",
+		"#.###.#.##...#.#.#..##..#",
+		"#.....#.#.##...###..##.#.",
+		"#######.#...#...#.##...##",
+	}
+
+	q, err := qrEncode([]byte("http://192.0.2.1:8080/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := qrRows(q.modules); !slices.Equal(got, want) {
+		t.Errorf("got\n%s", strings.Join(got, "\n"))
+	}
+}
+
+// Dark modules are rendered blank, with a quiet zone of two
+// modules around.
+func TestQRString(t *testing.T) {
+	q, err := qrEncode([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(q.String(), "\n"), "\n")
+
+	if len(lines) != 13 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	if lines[0] != strings.Repeat("█", 25) {
+		t.Errorf("quiet zone %q", lines[0])
+	}
+	// top rows of finder patterns
+	if want := "██ ▄▄▄▄▄ "; !strings.HasPrefix(lines[1], want) {
+		t.Errorf("line 1 %q, want prefix %q", lines[1], want)
+	}
+}
+
+func qrRows(modules [][]bool) []string {
+	var rows []string
+	for _, row := range modules {
+		var b strings.Builder
+		for _, dark := range row {
+			if dark {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		rows = append(rows, b.String())
+	}
+	return rows
+}
+
+// Decode a QR code of level L in byte mode, failing if any part
+// of it, including error correction, isn't as the standard says.
+func qrDecode(m [][]bool) (string, error) {
+	size := len(m)
+	version := (size - 17) / 4
+	bit := func(x, y int) int {
+		if m[y][x] {
+			return 1
+		}
+		return 0
+	}
+
+	// finder patterns and timing patterns
+	for _, c := range [][2]int{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+		for y := -1; y <= 7; y++ {
+			for x := -1; x <= 7; x++ {
+				d := max(abs(x-3), abs(y-3))
+				px, py := c[0]+x, c[1]+y
+				if px >= 0 && px < size && py >= 0 && py < size && m[py][px] != (d != 2 && d != 4) {
+					return "", fmt.Errorf("finder pattern at %d,%d", px, py)
+				}
+			}
+		}
+	}
+	for i := 8; i < size-8; i++ {
+		if m[6][i] != (i%2 == 0) || m[i][6] != (i%2 == 0) {
+			return "", fmt.Errorf("timing pattern at %d", i)
+		}
+	}
+	if !m[size-8][8] {
+		return "", fmt.Errorf("no dark module")
+	}
+
+	// format information, twice
+	var format, format2 int
+	first := [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8}, {5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}}
+	for i, p := range first {
+		format |= bit(p[0], p[1]) << i
+		if i < 8 {
+			format2 |= bit(size-1-i, 8) << i
+		} else {
+			format2 |= bit(8, size-15+i) << i
+		}
+	}
+	mask := slices.Index(qrFormatL[:], format)
+	if mask < 0 || format2 != format {
+		return "", fmt.Errorf("format information %015b, %015b", format, format2)
+	}
+
+	// version information, twice
+	if version >= 7 {
+		var info, info2 int
+		for i := 0; i < 18; i++ {
+			info |= bit(size-11+i%3, i/3) << i
+			info2 |= bit(i/3, size-11+i%3) << i
+		}
+		if info != qrVersionInfo[version] || info2 != info {
+			return "", fmt.Errorf("version information %018b, %018b", info, info2)
+		}
+	}
+
+	isFunction := func(x, y int) bool {
+		switch {
+		case x == 6 || y == 6:
+			return true
+		case x < 9 && y < 9, x >= size-8 && y < 9, x < 9 && y >= size-8:
+			return true
+		case version >= 7 && (x >= size-11 && x < size-8 && y < 6 || y >= size-11 && y < size-8 && x < 6):
+			return true
+		}
+		for _, cx := range qrCenters[version] {
+			for _, cy := range qrCenters[version] {
+				overlaps := cx < 9 && cy < 9 || cx > size-9 && cy < 9 || cx < 9 && cy > size-9
+				if !overlaps && abs(x-cx) <= 2 && abs(y-cy) <= 2 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	masks := []func(i, j int) bool{
+		func(i, j int) bool { return (i+j)%2 == 0 },
+		func(i, j int) bool { return i%2 == 0 },
+		func(i, j int) bool { return j%3 == 0 },
+		func(i, j int) bool { return (i+j)%3 == 0 },
+		func(i, j int) bool { return (i/2+j/3)%2 == 0 },
+		func(i, j int) bool { return i*j%2+i*j%3 == 0 },
+		func(i, j int) bool { return (i*j%2+i*j%3)%2 == 0 },
+		func(i, j int) bool { return ((i+j)%2+i*j%3)%2 == 0 },
+	}
+
+	// data modules, upwards and downwards in pairs of columns
+	// from the bottom right
+	var codewords []byte
+	var cur, n int
+	up := true
+	for right := size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for k := 0; k < size; k++ {
+			y := k
+			if up {
+				y = size - 1 - k
+			}
+			for x := right; x > right-2; x-- {
+				if isFunction(x, y) {
+					continue
+				}
+				cur = cur<<1 | bit(x, y)
+				if masks[mask](y, x) {
+					cur ^= 1
+				}
+				if n++; n%8 == 0 {
+					codewords = append(codewords, byte(cur))
+					cur = 0
+				}
+			}
+		}
+		up = !up
+	}
+
+	v := qrVersions[version-1]
+	if len(codewords) != v.total {
+		return "", fmt.Errorf("%d codewords, want %d", len(codewords), v.total)
+	}
+
+	// blocks are interleaved, the last ones may be longer
+	blocks := make([][]byte, v.blocks)
+	nData := (v.total - v.ecc*v.blocks) / v.blocks
+	long := (v.total - v.ecc*v.blocks) % v.blocks
+	k := 0
+	for i := 0; i <= nData; i++ {
+		for j := range blocks {
+			if i < nData || j >= v.blocks-long {
+				blocks[j] = append(blocks[j], codewords[k])
+				k++
+			}
+		}
+	}
+	// error correction is interleaved as well
+	var data []byte
+	for j := range blocks {
+		var ecc []byte
+		for i := 0; i < v.ecc; i++ {
+			ecc = append(ecc, codewords[k+i*v.blocks+j])
+		}
+		if !bytes.Equal(rsRemainder(blocks[j], rsDivisor(v.ecc)), ecc) {
+			return "", fmt.Errorf("error correction of block %d", j)
+		}
+		data = append(data, blocks[j]...)
+	}
+
+	// byte mode, then the length
+	var pos int
+	read := func(n int) int {
+		var r int
+		for i := 0; i < n; i++ {
+			r = r<<1 | int(data[pos/8]>>(7-pos%8)&1)
+			pos++
+		}
+		return r
+	}
+	if mode := read(4); mode != 0x4 {
+		return "", fmt.Errorf("mode %04b", mode)
+	}
+	length := read(8)
+	if version >= 10 {
+		length = length<<8 | read(8)
+	}
+	if 12+8*length > 8*len(data) {
+		return "", fmt.Errorf("length %d", length)
+	}
+	var b strings.Builder
+	for i := 0; i < length; i++ {
+		b.WriteByte(byte(read(8)))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Generate a self-signed certificate for the hostname and the
+// IP addresses of this machine. The private key is only kept
+// in memory and never written to disk.
+func selfSignedCert() (tls.Certificate, error) {
+	var (
+		cert   tls.Certificate
+		tmpl   x509.Certificate
+		key    *ecdsa.PrivateKey
+		der    []byte
+		serial *big.Int
+		addrs  []net.Addr
+		err    error
+	)
+
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return cert, err
+	}
+
+	if serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return cert, err
+	}
+
+	tmpl = x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"sharedir"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+		tmpl.Subject.CommonName = host
+	}
+
+	// not fatal, the certificate will be valid for localhost only
+	if addrs, err = net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, n.IP)
+			}
+		}
+	}
+
+	if der, err = x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key); err != nil {
+		return cert, err
+	}
+
+	cert.Certificate = [][]byte{der}
+	cert.PrivateKey = key
+	return cert, nil
+}
+
+// Format SHA-256 fingerprint of the certificate, the way
+// browsers display it.
+func fingerprint(cert tls.Certificate) string {
+	var hex []string
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	for _, b := range sum {
+		hex = append(hex, fmt.Sprintf("%02X", b))
+	}
+
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,257 @@
+package sharedir
+
+import (
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// URL path of the event stream of a directory, e.g.
+// '/~events?path=a/b'.
+const eventsPrefix = "/~events"
+
+const (
+	eventsSettle    = 200 * time.Millisecond // changes are collected for this long
+	eventsKeepAlive = 15 * time.Second       // interval of comments keeping the stream open
+)
+
+// Send a 'change' Server-Sent Event whenever entries of the
+// directory given by the "path" query parameter are added,
+// removed or modified, for listings to reload themselves.
+// Changes are noticed with fsnotify, so only directories on disk
+// send events, those of Config.FS are not expected to change.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.live {
+		serveFailure(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	if s.noListing {
+		serveFailure(w, r, http.StatusForbidden, "listing is disabled")
+		return
+	}
+
+	sp := s.parseSafePath("/" + r.URL.Query().Get("path"))
+	if sp == nil || sp.root == "" {
+		serveFailure(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	inf, code := s.statShared(sp)
+	if code != http.StatusOK {
+		serveFailure(w, r, code, http.StatusText(code))
+		return
+	}
+	if !inf.IsDir() {
+		serveFailure(w, r, http.StatusBadRequest, "not a directory")
+		return
+	}
+	if !s.authorized(w, r, sp, true) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// nil channel if not on disk, i.e. never receives
+	var changed chan struct{}
+	if sp.local {
+		var err error
+		if changed, err = s.watcher.subscribe(sp.abs); err != nil {
+			log.Printf("     watch [%s]: %v", sp.abs, err)
+			serveFailure(w, r, http.StatusServiceUnavailable, "can't watch directory")
+			return
+		}
+		defer s.watcher.unsubscribe(sp.abs, changed)
+	}
+
+	// before the stream starts, changes the client makes once it
+	// is open must differ from this
+	last := s.dirState(sp)
+
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	// the stream stays open, unlike requests the read timeout is meant for
+	rc.SetReadDeadline(time.Time{})
+
+	// clients reconnect after a second if the stream breaks
+	io.WriteString(w, "retry: 1000\n\n")
+	rc.Flush()
+
+	alive := time.NewTicker(eventsKeepAlive)
+	defer alive.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.quit:
+			return
+		case <-alive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case <-changed:
+			// let a burst of changes (e.g. of a file being written)
+			// settle, they are reported as one
+			select {
+			case <-time.After(eventsSettle):
+			case <-r.Context().Done():
+				return
+			}
+			select {
+			case <-changed:
+			default:
+			}
+
+			// e.g. hidden or ignored files don't change the listing
+			state := s.dirState(sp)
+			if state == last {
+				continue
+			}
+			last = state
+			debugf("     [%s] changed", sp.abs)
+			_, err = io.WriteString(w, "event: change\ndata: "+url.PathEscape(sp.rel)+"\n\n")
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			debugf("     event stream: %v", err)
+			return
+		}
+	}
+}
+
+// Hash of names, sizes and modification times of the shared
+// entries of directory p, which changes with any of them. 0 if
+// it can't be read.
+func (s *Server) dirState(p *safePath) uint64 {
+	entries, err := fs.ReadDir(p.fsys, p.name)
+	if err != nil {
+		log.Printf("     read dir: %v", err)
+		return 0
+	}
+
+	h := fnv.New64a()
+	for _, e := range s.filterEntries(p, entries) {
+		io.WriteString(h, e.Name()+"\x00")
+		if inf, err := e.Info(); err == nil {
+			io.WriteString(h, strconv.FormatInt(inf.Size(), 10)+"\x00"+strconv.FormatInt(inf.ModTime().UnixNano(), 10)+"\x00")
+		}
+	}
+	return h.Sum64()
+}
+
+// Watches the directories of event streams with a single
+// fsnotify.Watcher, since the number of those is limited (e.g.
+// by inotify). Each directory is watched as long as it has
+// subscribers.
+type dirWatcher struct {
+	w *fsnotify.Watcher
+
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]bool // by absolute path of the directory
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dirWatcher{w: w, subs: make(map[string]map[chan struct{}]bool)}
+	go d.run()
+	return d, nil
+}
+
+// Get notified about changes in directory dir. The channel
+// receives a value if there were changes since it was last read.
+func (d *dirWatcher) subscribe(dir string) (chan struct{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.subs[dir] == nil {
+		if err := d.w.Add(dir); err != nil {
+			return nil, err
+		}
+		d.subs[dir] = make(map[chan struct{}]bool)
+	}
+
+	c := make(chan struct{}, 1)
+	d.subs[dir][c] = true
+	return c, nil
+}
+
+// Stop notifying c, and watching dir if it was the last one.
+func (d *dirWatcher) unsubscribe(dir string, c chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.subs[dir], c)
+	if len(d.subs[dir]) == 0 {
+		delete(d.subs, dir)
+		// fails if the directory was removed, which ended the watch
+		d.w.Remove(dir)
+	}
+}
+
+// Notify the subscribers of the directories that events are
+// about, until the watcher is closed.
+func (d *dirWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-d.w.Events:
+			if !ok {
+				return
+			}
+			d.notify(filepath.Dir(ev.Name))
+			// the directory itself, e.g. removed
+			d.notify(ev.Name)
+		case err, ok := <-d.w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watch directories: %v", err)
+		}
+	}
+}
+
+func (d *dirWatcher) notify(dir string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for c := range d.subs[dir] {
+		select {
+		case c <- struct{}{}:
+		default:
+			// a change is pending already
+		}
+	}
+}
+
+// End event streams, which would otherwise keep the server from
+// shutting down, and stop watching directories. Called via
+// http.Server.RegisterOnShutdown.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.quit)
+		if s.watcher != nil {
+			s.watcher.w.Close()
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package sharedir
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeEvents(t *testing.T) {
+	dir := testDir(t, map[string]string{"sub/a.txt": "a"})
+	cfg := testConfig(dir)
+	cfg.Live = true
+	cfg.Recursive = true
+	ts := httptest.NewServer(testServer(t, cfg))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + eventsPrefix + "?path=sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		close(lines)
+	}()
+
+	// the stream starts with the retry interval, after subscribing
+	if l := <-lines; !strings.HasPrefix(l, "retry:") {
+		t.Fatalf("first line %q", l)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				t.Fatal("stream ended")
+			}
+			if l == "event: change" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no event after creating a file")
+		}
+	}
+}
+
+func TestServeEventsFailure(t *testing.T) {
+	dir := testDir(t, map[string]string{"sub/a.txt": "a"})
+	cfg := testConfig(dir)
+	cfg.Live = true
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		name   string
+		target string
+		code   int
+	}{
+		{"missing", eventsPrefix + "?path=nope", http.StatusNotFound},
+		{"file", eventsPrefix + "?path=sub/a.txt", http.StatusBadRequest},
+		{"outside", eventsPrefix + "?path=../", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(s, http.MethodGet, tt.target); w.Code != tt.code {
+				t.Errorf("status %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+
+	t.Run("not live", func(t *testing.T) {
+		s := testServer(t, testConfig(dir))
+		if w := request(s, http.MethodGet, eventsPrefix+"?path=sub"); w.Code != http.StatusNotFound {
+			t.Errorf("status %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package sharedir_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/vgratian/sharedir"
+)
+
+// Share a directory under /files/ of another mux.
+func ExampleNewHandler() {
+	dir, err := os.MkdirTemp("", "sharedir")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := sharedir.DefaultConfig()
+	cfg.Dirs = []string{dir}
+	cfg.Prefix = "/files"
+
+	mux := http.NewServeMux()
+	mux.Handle("/files/", sharedir.NewHandler(cfg))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "home")
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for _, p := range []string{"/files/hello.txt", "/"} {
+		res, err := http.Get(ts.URL + p)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		fmt.Println(p, res.StatusCode, string(b))
+	}
+	// Output:
+	// /files/hello.txt 200 hello
+	// / 200 home
+}
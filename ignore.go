@@ -0,0 +1,136 @@
+package sharedir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// File at the root of a shared directory listing paths that
+// are not shared, in the format of .gitignore.
+const ignoreFile = ".sharedirignore"
+
+type ignoreRule struct {
+	pattern  string // slash-separated glob, "**" matches any number of segments
+	negate   bool   // "!": path is shared again
+	dirOnly  bool   // trailing "/": only matches directories
+	anchored bool   // contains "/": matched against the whole path, else the name
+}
+
+// Rules of an ignore file, nil if there is none.
+type ignoreList []ignoreRule
+
+// Read the ignore file at the root of fsys. Returns nil if
+// there is none.
+func readIgnore(fsys fs.FS) (ignoreList, error) {
+	var rules ignoreList
+
+	data, err := fs.ReadFile(fsys, ignoreFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var r ignoreRule
+
+		if r.negate = strings.HasPrefix(line, "!"); r.negate {
+			line = line[1:]
+		}
+		// escaped leading "#" or "!"
+		line = strings.TrimPrefix(line, `\`)
+
+		if r.dirOnly = strings.HasSuffix(line, "/"); r.dirOnly {
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+
+		if r.pattern != "" {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules, sc.Err()
+}
+
+// Check if the path name (slash-separated, relative to the root)
+// is ignored, either itself or because one of its parent
+// directories is. The ignore file itself is always ignored, in
+// any case.
+func (l ignoreList) ignored(name string, isDir bool) bool {
+	if strings.EqualFold(name, ignoreFile) {
+		return true
+	}
+	if len(l) == 0 || name == "." {
+		return false
+	}
+
+	segments := strings.Split(name, "/")
+	for i := range segments {
+		// like git, files in an ignored directory can't be shared again
+		if l.match(strings.Join(segments[:i+1], "/"), i < len(segments)-1 || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the path itself is ignored, the last matching
+// rule decides.
+func (l ignoreList) match(name string, isDir bool) bool {
+	ignored := false
+
+	for _, r := range l {
+		if r.dirOnly && !isDir {
+			continue
+		}
+
+		target := name
+		if !r.anchored {
+			target = path.Base(name)
+		}
+
+		if globMatch(strings.Split(r.pattern, "/"), strings.Split(target, "/")) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// Match path segments against pattern segments, where "**"
+// matches any number of segments.
+func globMatch(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if globMatch(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
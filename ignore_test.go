@@ -0,0 +1,103 @@
+package sharedir
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIgnored(t *testing.T) {
+	conf := `# comment
+*.log
+build/
+/top.txt
+docs/**/draft-*
+secret
+!keep.log
+\#hash
+`
+	rules, err := readIgnore(fstest.MapFS{ignoreFile: {Data: []byte(conf)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{"a.log", false, true},
+		{"sub/a.log", false, true},
+		{"keep.log", false, false},
+		{"a.txt", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"sub/build", true, true},
+		{"build/out.bin", false, true},
+		{"top.txt", false, true},
+		{"sub/top.txt", false, false},
+		{"docs/draft-1.md", false, true},
+		{"docs/a/b/draft-2.md", false, true},
+		{"docs/final.md", false, false},
+		{"other/draft-1.md", false, false},
+		{"secret", true, true},
+		{"secret/keep.log", false, true},
+		{"#hash", false, true},
+		{ignoreFile, false, true},
+		{strings.ToUpper(ignoreFile), false, true},
+		{".", true, false},
+	}
+
+	for _, tt := range tests {
+		if got := rules.ignored(tt.name, tt.isDir); got != tt.want {
+			t.Errorf("ignored(%q, %t) = %t", tt.name, tt.isDir, got)
+		}
+	}
+
+	// without ignore file only the ignore file itself is
+	if got, err := readIgnore(fstest.MapFS{}); err != nil || got != nil || got.ignored("a.log", false) || !got.ignored(ignoreFile, false) {
+		t.Errorf("without ignore file: %v, %v", got, err)
+	}
+}
+
+func TestIgnoreFile(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{
+		ignoreFile:      "*.log\nbuild/\n",
+		"a.txt":         "a",
+		"debug.log":     "log",
+		"build/out.bin": "bin",
+		"sub/trace.log": "log",
+		"sub/b.txt":     "b",
+	}))
+	cfg.Recursive = true
+	cfg.Hidden = true
+	s := testServer(t, cfg)
+
+	if got := listingNames(t, s, "/"); !slices.Equal(got, []string{"sub", "a.txt"}) {
+		t.Errorf("listing %q", got)
+	}
+	if got := listingNames(t, s, "/sub/"); !slices.Equal(got, []string{"b.txt"}) {
+		t.Errorf("listing of sub %q", got)
+	}
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/a.txt", http.StatusOK},
+		{"/sub/b.txt", http.StatusOK},
+		{"/debug.log", http.StatusNotFound},
+		{"/sub/trace.log", http.StatusNotFound},
+		{"/build/", http.StatusNotFound},
+		{"/build/out.bin", http.StatusNotFound},
+		{"/" + ignoreFile, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		if w := request(s, http.MethodGet, tt.target); w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package sharedir
+
+import "log"
+
+// Verbosity of logging. Startup messages and errors are
+// always logged.
+type LogLevel int
+
+const (
+	LogQuiet LogLevel = iota // only startup messages and errors
+	LogInfo                  // also requests and transfers
+	LogDebug                 // also details like resolved paths
+)
+
+var verbosity = LogInfo
+
+// Set the verbosity of logging of all servers, LogInfo by default.
+func SetLogLevel(l LogLevel) {
+	verbosity = l
+}
+
+// Log message about a request, unless in quiet mode.
+func infof(format string, v ...any) {
+	if verbosity >= LogInfo {
+		log.Printf(format, v...)
+	}
+}
+
+// Log message only in verbose mode.
+func debugf(format string, v ...any) {
+	if verbosity >= LogDebug {
+		log.Printf(format, v...)
+	}
+}
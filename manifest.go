@@ -0,0 +1,146 @@
+package sharedir
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"time"
+)
+
+// URL path of the manifest, a list of all shared files.
+const manifestPrefix = "/~manifest"
+
+const manifestVisits = 1000000 // max number of entries visited
+
+var errManifestDone = errors.New("manifest done")
+
+// File in the manifest.
+type manifestEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"` // URL path, unescaped, without prefix
+	URL     string    `json:"url"`  // absolute URL, see Server.absURL
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	Type    string    `json:"type"`
+}
+
+// Serve all shared files (of subdirectories too, in recursive
+// mode) as JSON, for tools that mirror the share:
+//
+//	{"files": [{"name": ..., "path": ..., "url": ..., ...}, ...], "truncated": false}
+//
+// Entries are written as they are found, so the whole list is
+// never kept in memory. The walk stops after manifestVisits
+// entries, which is reported as truncated.
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request) {
+	if !s.manifest {
+		serveFailure(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	if s.noListing {
+		serveFailure(w, r, http.StatusForbidden, "listing is disabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	count := 0
+	bw.WriteString(`{"files":[`)
+
+	truncated, err := s.walkShared(func(p *safePath, inf fs.FileInfo) error {
+		mimet, _ := s.guessMimeType(inf.Name(), nil)
+
+		b, err := json.Marshal(manifestEntry{inf.Name(), "/" + p.rel, s.absURL(r, "/"+escapePath(p.rel)), inf.Size(), inf.ModTime(), mimet})
+		if err != nil {
+			return err
+		}
+
+		if count += 1; count > 1 {
+			bw.WriteByte(',')
+		}
+		_, err = bw.Write(b)
+		return err
+	})
+
+	// the response is partially written, so we can only log
+	if err != nil {
+		log.Printf("     manifest: %v", err)
+		return
+	}
+
+	if truncated {
+		bw.WriteString(`],"truncated":true}` + "\n")
+	} else {
+		bw.WriteString(`],"truncated":false}` + "\n")
+	}
+	infof("     listed %d files", count)
+}
+
+// Walk the shared directories like search and call fn for each
+// shared file. Returns true if the walk was stopped after
+// manifestVisits entries.
+func (s *Server) walkShared(fn func(p *safePath, inf fs.FileInfo) error) (bool, error) {
+	visits := 0
+
+	for i := range s.mounts {
+		root := s.rootPath(&s.mounts[i])
+		if protected(root) {
+			continue
+		}
+
+		err := fs.WalkDir(root.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			// unreadable directories are skipped
+			if err != nil || name == "." {
+				return nil
+			}
+
+			if visits += 1; visits > manifestVisits {
+				return errManifestDone
+			}
+
+			if !s.shared(root.child(path.Dir(name)), d) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			if d.IsDir() {
+				// names inside are not revealed without credentials
+				if !s.recursive || protected(root.child(name)) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			// of the target of symlinks (those to directories are not
+			// followed), the entry might also have been removed
+			p := root.child(name)
+			inf, err := fs.Stat(p.fsys, p.name)
+			if err != nil || inf.IsDir() {
+				return nil
+			}
+			return fn(p, inf)
+		})
+
+		if err == errManifestDone {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
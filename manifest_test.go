@@ -0,0 +1,103 @@
+package sharedir
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.txt":            "abc",
+		"docs/b.html":      "<p>",
+		"docs/old/c.md":    "",
+		".hidden":          "",
+		"priv/" + authFile: "u:p\n",
+		"priv/d.txt":       "",
+		"tmp/e.log":        "",
+		ignoreFile:         "tmp\n",
+	})
+
+	type entry struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+		URL  string `json:"url"`
+		Size int64  `json:"size"`
+		Type string `json:"type"`
+	}
+	type manifest struct {
+		Files     []entry `json:"files"`
+		Truncated *bool   `json:"truncated"`
+	}
+
+	tests := []struct {
+		recursive bool
+		want      []string
+	}{
+		{false, []string{"/a.txt"}},
+		{true, []string{"/a.txt", "/docs/b.html", "/docs/old/c.md"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("recursive=%t", tt.recursive), func(t *testing.T) {
+			cfg := testConfig(dir)
+			cfg.Recursive = tt.recursive
+			cfg.Manifest = true
+			s := testServer(t, cfg)
+
+			w := request(s, http.MethodGet, manifestPrefix)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type %q", ct)
+			}
+
+			var m manifest
+			if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+				t.Fatalf("%v: %s", err, w.Body)
+			}
+			if m.Truncated == nil || *m.Truncated {
+				t.Errorf("truncated %v", m.Truncated)
+			}
+
+			var paths []string
+			for _, e := range m.Files {
+				paths = append(paths, e.Path)
+			}
+			slices.Sort(paths)
+			if !slices.Equal(paths, tt.want) {
+				t.Fatalf("paths %q, want %q", paths, tt.want)
+			}
+
+			for _, e := range m.Files {
+				if e.Path != "/a.txt" {
+					continue
+				}
+				want := entry{"a.txt", "/a.txt", "http://example.com/a.txt", 3, "text/plain; charset=utf-8"}
+				if e != want {
+					t.Errorf("entry %+v, want %+v", e, want)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestDisabled(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": ""})
+
+	s := testServer(t, testConfig(dir))
+	if w := request(s, http.MethodGet, manifestPrefix); w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	cfg := testConfig(dir)
+	cfg.Manifest = true
+	cfg.NoListing = true
+	s = testServer(t, cfg)
+	if w := request(s, http.MethodGet, manifestPrefix); w.Code != http.StatusForbidden {
+		t.Errorf("no listing: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,76 @@
+package sharedir
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gomarkdown/markdown"
+	mdhtml "github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+)
+
+// Convert Markdown source to HTML, with the common extensions
+// (e.g. tables and fenced code). Raw HTML is dropped and links
+// with schemes which execute code when clicked (e.g.
+// "javascript:") are not rendered as links. The parser limits
+// the nesting of blocks and emphasis, so deeply nested input
+// can't exhaust the stack.
+func renderMarkdown(src []byte) []byte {
+	p := parser.NewWithExtensions(parser.CommonExtensions)
+	r := mdhtml.NewRenderer(mdhtml.RendererOptions{Flags: mdhtml.SkipHTML | mdhtml.Safelink})
+	return markdown.ToHTML(src, p, r)
+}
+
+// Page wrapping rendered Markdown, styled like the listing.
+var markdownPage = template.Must(template.New("markdown").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<title>sharedir: {{ .Name }}</title>
+		<link rel="icon" type="image/x-icon" href="{{ .Prefix }}/~favicon.ico">
+		<style type="text/css">
+			html * { color: #323232 !important; }
+			body { max-width: 50em; margin: auto; padding: 1em; }
+			pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+			blockquote { border-left: 3px solid #ccc; margin-left: 0; padding-left: 1em; }
+			img { max-width: 100%; }
+		</style>
+	</head>
+	<body>
+		<small><a href="?raw=1">view source</a></small>
+		{{ .Body }}
+	</body>
+</html>
+`))
+
+// Serve Markdown file f rendered as an HTML page.
+func serveMarkdown(w http.ResponseWriter, r *http.Request, f io.ReadSeeker, inf os.FileInfo) {
+	var buf bytes.Buffer
+
+	src, err := io.ReadAll(f)
+	if err != nil {
+		log.Printf("     read file [%s]: %v", inf.Name(), err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	err = markdownPage.Execute(&buf, struct {
+		Name   string
+		Body   template.HTML
+		Prefix string
+	}{inf.Name(), template.HTML(renderMarkdown(src)), linkPrefix(r)})
+	if err != nil {
+		log.Printf("     execute markdown page: %v", err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+	http.ServeContent(w, r, inf.Name(), inf.ModTime(), bytes.NewReader(buf.Bytes()))
+	infof("     served markdown file of %d bytes rendered as HTML", inf.Size())
+}
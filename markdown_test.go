@@ -0,0 +1,108 @@
+package sharedir
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMarkdown(t *testing.T) {
+	dir := testDir(t, map[string]string{"doc.md": "# Title\n\nSome *text*.\n"})
+	cfg := testConfig(dir)
+	cfg.Markdown = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   string
+		ctype  string
+	}{
+		{"rendered", "/doc.md", "text/html", "<h1", "text/html"},
+		{"raw", "/doc.md?raw=1", "text/html", "# Title", "text/markdown"},
+		{"not a browser", "/doc.md", "*/*", "# Title", "text/markdown"},
+		{"download", "/doc.md?download=1", "text/html", "# Title", "text/markdown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(s, http.MethodGet, tt.target, "Accept", tt.accept)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("body %q doesn't contain %q", w.Body, tt.want)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.ctype) {
+				t.Errorf("Content-Type %q, want %q", ct, tt.ctype)
+			}
+		})
+	}
+}
+
+func TestServeMarkdownDisabled(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"doc.md": "# Title\n"})))
+
+	w := request(s, http.MethodGet, "/doc.md", "Accept", "text/html")
+	if strings.Contains(w.Body.String(), "<h1") {
+		t.Errorf("rendered without -markdown: %q", w.Body)
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+		not  string
+	}{
+		{"heading", "## Sub", "<h2", ""},
+		{"emphasis", "a **b** c", "<strong>b</strong>", ""},
+		{"code", "```\n<b>\n```", "&lt;b&gt;", "<b>"},
+		{"list", "- a\n- b", "<li>a</li>", ""},
+		{"link", "[a](https://example.com)", `href="https://example.com"`, ""},
+		{"raw html", "<script>alert(1)</script>", "", "<script"},
+		{"inline html", "a <img src=x onerror=alert(1)> b", "", "onerror"},
+		{"javascript link", "[a](javascript:alert(1))", "", `href="javascript`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := string(renderMarkdown([]byte(tt.src)))
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("%q doesn't contain %q", out, tt.want)
+			}
+			if tt.not != "" && strings.Contains(out, tt.not) {
+				t.Errorf("%q contains %q", out, tt.not)
+			}
+		})
+	}
+}
+
+// Deeply nested input must neither exhaust the stack, which
+// would crash the process, nor take long to render.
+func TestRenderMarkdownNesting(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"blockquotes", strings.Repeat(">", 2_000_000)},
+		{"lists", strings.Repeat("- ", 1_000_000)},
+		{"ordered lists", strings.Repeat("1. ", 700_000)},
+		{"mixed", strings.Repeat("> - ", 500_000)},
+		{"emphasis", strings.Repeat("*", 1_000_000) + "a" + strings.Repeat("*", 1_000_000)},
+		{"links", strings.Repeat("[a](", 500_000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			renderMarkdown([]byte(tt.src))
+			if d := time.Since(start); d > 10*time.Second {
+				t.Errorf("took %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package sharedir
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wrap handler to require HTTP basic authentication with the
+// given credentials. Requests for which exempt (if not nil)
+// returns true are let through, e.g. signed links.
+func BasicAuth(next http.Handler, user, pass string, exempt func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt != nil && exempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, p, ok := r.BasicAuth()
+
+		// compare both, so that timing doesn't reveal which one is wrong
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+
+		if !ok || !userOk || !passOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sharedir", charset="UTF-8"`)
+			serveFailure(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wrap handler to allow cross-origin requests from origin ("*"
+// for any) and answer CORS preflight requests. Preflights carry
+// no credentials, so this has to wrap BasicAuth.
+func CORS(next http.Handler, origin string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if origin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		// plain OPTIONS requests are WebDAV's
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Content-Disposition, ETag")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+		if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+			w.Header().Set("Access-Control-Allow-Headers", h)
+		}
+		w.Header().Set("Access-Control-Max-Age", "86400")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Wrap handler to gzip-compress responses of compressible content
+// types when the client accepts it.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// Check if the Accept-Encoding header of the request allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		e, q, _ := strings.Cut(strings.TrimSpace(e), ";")
+		if strings.TrimSpace(e) == "gzip" && strings.ReplaceAll(q, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if content of this type is worth compressing. Images,
+// archives, etc. are usually compressed already.
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	// events have to be sent right away, not buffered by gzip
+	if mediaType == "text/event-stream" {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+xml"), strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml":
+		return true
+	}
+
+	return false
+}
+
+// Response writer that compresses the body if the content type,
+// known when the header is written, is compressible.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	h := g.Header()
+	// partial content (range requests) must be sent as is
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		// the compressed bytes differ from those the ETag stands for
+		if et := h.Get("ETag"); et != "" && !strings.HasPrefix(et, "W/") {
+			h.Set("ETag", "W/"+et)
+		}
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Flush remaining compressed data, if any.
+func (g *gzipWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// Allow http.ResponseController to access the original writer.
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// IP address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Wrap handler to limit each client IP to n requests per
+// second on average, allowing bursts of up to n requests.
+func RateLimit(next http.Handler, n float64) http.Handler {
+	l := &rateLimiter{rate: n, buckets: make(map[string]*bucket)}
+	go l.cleanup(time.Minute)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(clientIP(r), time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			serveFailure(w, r, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Token bucket of a client.
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens were last updated
+}
+
+// Rate limiter with a token bucket per client IP. Each bucket
+// holds up to rate tokens (at least one) and is refilled with
+// rate tokens per second.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	buckets map[string]*bucket
+}
+
+// Take a token from the bucket of ip, if there is any left.
+func (l *rateLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst(), last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst() {
+		b.tokens = l.burst()
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// Size of the buckets. Rates below one request per second still
+// allow one, otherwise no request would ever be let through.
+func (l *rateLimiter) burst() float64 {
+	return max(l.rate, 1)
+}
+
+// Periodically remove buckets of clients that were idle long
+// enough for them to be refilled, so that the map doesn't
+// grow with every client ever seen.
+func (l *rateLimiter) cleanup(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		l.prune(now)
+	}
+}
+
+// Remove buckets that are full at time now.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst() {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// Wrap handler to refuse clients whose IP address is not in
+// one of the allowed networks.
+func AllowNets(next http.Handler, allowed []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := net.ParseIP(clientIP(r)); ip != nil && inNets(ip, allowed) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		infof("%s: %s - refused, not in allowed networks", r.Method, r.RemoteAddr)
+		serveFailure(w, r, http.StatusForbidden, "forbidden")
+	})
+}
+
+// Check if ip is in one of the networks.
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap handler to take the client address from X-Forwarded-For
+// or X-Real-IP if the request comes from one of the trusted
+// proxies, so that logs, rate limits and allowed networks see
+// the client instead of the proxy. The headers of other peers
+// are ignored, since clients can set them to anything.
+func TrustProxy(next http.Handler, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer := net.ParseIP(clientIP(r)); peer != nil && inNets(peer, trusted) {
+			if ip := forwardedIP(r, trusted); ip != "" {
+				_, port, _ := net.SplitHostPort(r.RemoteAddr)
+				r = r.WithContext(context.WithValue(r.Context(), peerKey{}, r.RemoteAddr))
+				r.RemoteAddr = net.JoinHostPort(ip, port)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Key of the address of the proxy in the context of requests
+// whose RemoteAddr was replaced by TrustProxy.
+type peerKey struct{}
+
+// IP address the request was received from, i.e. of the proxy
+// if TrustProxy took the client's from the headers.
+func peerIP(r *http.Request) net.IP {
+	addr, ok := r.Context().Value(peerKey{}).(string)
+	if !ok {
+		addr = r.RemoteAddr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// Client address given by proxies, empty if there is none.
+// X-Forwarded-For is read from the right, each proxy appends the
+// address it got the request from, and the first address that
+// is not a trusted proxy is the client. Anything left of it
+// might be forged.
+func forwardedIP(r *http.Request, trusted []*net.IPNet) string {
+	if v := r.Header.Values("X-Forwarded-For"); len(v) > 0 {
+		var ip net.IP
+
+		hops := strings.Split(strings.Join(v, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			if ip = hop; !inNets(ip, trusted) {
+				break
+			}
+		}
+
+		if ip != nil {
+			return ip.String()
+		}
+		return ""
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// Wrap handler to log each request after it is served, in the
+// Common Log Format of Apache, or the Combined Log Format which
+// adds referer and user agent.
+func AccessLog(next http.Handler, combined bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		user, _, ok := r.BasicAuth()
+		if !ok || user == "" {
+			user = "-"
+		}
+
+		size := "-"
+		if sw.size > 0 {
+			size = strconv.FormatInt(sw.size, 10)
+		}
+
+		line := fmt.Sprintf("%s - %s [%s] %q %d %s",
+			clientIP(r),
+			user,
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto,
+			sw.status,
+			size,
+		)
+
+		if combined {
+			line += fmt.Sprintf(" %q %q", orDash(r.Referer()), orDash(r.UserAgent()))
+		}
+
+		// without the timestamp prefix of the logger
+		fmt.Fprintln(log.Writer(), line)
+	})
+}
+
+// Entry of the JSON access log.
+type jsonLogEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	RequestID  string    `json:"request_id"`
+	Method     string    `json:"method"`
+	RemoteIP   string    `json:"remote_ip"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+// Wrap handler to log each request after it is served as one
+// JSON object per line. Each request gets an ID, which is sent
+// back in the X-Request-ID header so that clients can refer to
+// the log entry. An ID set by a proxy in front is kept.
+func JSONLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(sw, r)
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		b, err := json.Marshal(jsonLogEntry{
+			Timestamp:  start.UTC(),
+			RequestID:  id,
+			Method:     r.Method,
+			RemoteIP:   clientIP(r),
+			Path:       r.URL.Path,
+			Status:     sw.status,
+			Bytes:      sw.size,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		})
+		if err != nil {
+			log.Printf("encode log entry: %v", err)
+			return
+		}
+
+		// without the timestamp prefix of the logger
+		fmt.Fprintln(log.Writer(), string(b))
+	})
+}
+
+// Random request ID of 16 hex digits.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Check if a request ID from a client or proxy is safe to log
+// and send back, i.e. short and printable ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Response writer that records status code and number of bytes
+// of the response body.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// Copy with the original writer, which keeps sendfile working
+// for files (http.ServeContent copies with io.CopyN).
+func (s *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := io.Copy(s.ResponseWriter, src)
+	s.size += n
+	return n, err
+}
+
+// Allow http.ResponseController to access the original writer.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,457 @@
+package sharedir
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Handler answering every request with "ok".
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+})
+
+func TestBasicAuth(t *testing.T) {
+	exempt := func(r *http.Request) bool { return r.URL.Path == "/public" }
+	h := BasicAuth(okHandler, "alice", "secret", exempt)
+
+	tests := []struct {
+		name   string
+		target string
+		user   string
+		pass   string
+		code   int
+	}{
+		{"missing header", "/", "", "", http.StatusUnauthorized},
+		{"wrong password", "/", "alice", "wrong", http.StatusUnauthorized},
+		{"wrong user", "/", "bob", "secret", http.StatusUnauthorized},
+		{"empty password", "/", "alice", "", http.StatusUnauthorized},
+		{"correct", "/", "alice", "secret", http.StatusOK},
+		{"exempt", "/public", "", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+
+			w := send(h, r)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if wa := w.Header().Get("WWW-Authenticate"); (w.Code == http.StatusUnauthorized) != (wa != "") {
+				t.Errorf("WWW-Authenticate %q", wa)
+			}
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.txt": strings.Repeat("compressible text ", 100),
+		"b.png": "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100),
+	})
+	h := Compress(testServer(t, testConfig(dir)))
+
+	tests := []struct {
+		name     string
+		target   string
+		encoding string
+		header   []string
+		gzipped  bool
+	}{
+		{"text", "/a.txt", "gzip", nil, true},
+		{"text with q", "/a.txt", "deflate, gzip;q=0.8", nil, true},
+		{"not accepted", "/a.txt", "", nil, false},
+		{"refused", "/a.txt", "gzip;q=0", nil, false},
+		{"image", "/b.png", "gzip", nil, false},
+		{"listing", "/", "gzip", []string{"Accept", "text/html"}, true},
+		{"range", "/a.txt", "gzip", []string{"Range", "bytes=0-9"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(h, http.MethodGet, tt.target, append([]string{"Accept-Encoding", tt.encoding}, tt.header...)...)
+			if w.Code != http.StatusOK && w.Code != http.StatusPartialContent {
+				t.Fatalf("status %d", w.Code)
+			}
+
+			gzipped := w.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.gzipped {
+				t.Fatalf("Content-Encoding %q", w.Header().Get("Content-Encoding"))
+			}
+			if !gzipped {
+				return
+			}
+
+			if cl := w.Header().Get("Content-Length"); cl != "" {
+				t.Errorf("Content-Length %s", cl)
+			}
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.target == "/a.txt" && string(b) != strings.Repeat("compressible text ", 100) {
+				t.Errorf("decompressed %q", b)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := RateLimit(okHandler, 3)
+
+	get := func(ip string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		return send(h, r).Code
+	}
+
+	// a burst of 3 requests is allowed
+	for i := range 3 {
+		if code := get("192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, code)
+		}
+	}
+	if code := get("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Errorf("exceeding: status %d", code)
+	}
+
+	// others are limited separately
+	if code := get("192.0.2.2"); code != http.StatusOK {
+		t.Errorf("other client: status %d", code)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name  string
+		rate  float64
+		times []time.Duration // of requests since start
+		want  []bool
+	}{
+		{"burst", 2, []time.Duration{0, 0, 0}, []bool{true, true, false}},
+		{"refilled", 2, []time.Duration{0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond}, []bool{true, true, false, true, false}},
+		{"below one per second", 0.5, []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second}, []bool{true, false, true, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{rate: tt.rate, buckets: make(map[string]*bucket)}
+			for i, d := range tt.times {
+				if got := l.allow("192.0.2.1", start.Add(d)); got != tt.want[i] {
+					t.Errorf("request %d at %s: %t", i+1, d, got)
+				}
+			}
+		})
+	}
+}
+
+// Buckets of idle clients are removed, those of recent ones kept.
+func TestRateLimiterPrune(t *testing.T) {
+	start := time.Now()
+	l := &rateLimiter{rate: 1, buckets: make(map[string]*bucket)}
+
+	l.allow("192.0.2.1", start)
+	l.allow("192.0.2.2", start.Add(time.Minute))
+
+	l.prune(start.Add(time.Minute))
+	if _, ok := l.buckets["192.0.2.1"]; ok {
+		t.Error("idle client kept")
+	}
+	if _, ok := l.buckets["192.0.2.2"]; !ok {
+		t.Error("recent client removed")
+	}
+}
+
+func TestAllowNets(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	h := AllowNets(okHandler, []*net.IPNet{lan, v6})
+
+	tests := []struct {
+		remote string
+		code   int
+	}{
+		{"192.168.1.5:1234", http.StatusOK},
+		{"192.168.1.255:1234", http.StatusOK},
+		{"[::ffff:192.168.1.5]:1234", http.StatusOK},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"192.168.2.5:1234", http.StatusForbidden},
+		{"10.0.0.1:1234", http.StatusForbidden},
+		{"[2001:db9::1]:1234", http.StatusForbidden},
+		{"invalid", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		if w := send(h, r); w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.remote, w.Code, tt.code)
+		}
+	}
+}
+
+// Capture what is logged while the test runs.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "0123456789"})))
+
+	tests := []struct {
+		name     string
+		combined bool
+		target   string
+		header   []string
+		want     string
+	}{
+		{"common", false, "/a.txt", nil, `^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\.txt HTTP/1\.1" 200 10$`},
+		{"range", false, "/a.txt", []string{"Range", "bytes=0-3"}, `"GET /a\.txt HTTP/1\.1" 206 4$`},
+		{"not found", false, "/missing?x=1", nil, `"GET /missing\?x=1 HTTP/1\.1" 404 \d+$`},
+		{"combined", true, "/a.txt", []string{"Referer", "http://example.com/", "User-Agent", `curl "8"`}, `"GET /a\.txt HTTP/1\.1" 200 10 "http://example.com/" "curl \\"8\\""$`},
+		{"combined without", true, "/a.txt", []string{"User-Agent", ""}, `200 10 "-" "-"$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLog(t)
+			SetLogLevel(LogQuiet)
+			defer SetLogLevel(LogInfo)
+
+			request(AccessLog(s, tt.combined), http.MethodGet, tt.target, tt.header...)
+
+			// errors are logged before
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if !regexp.MustCompile(tt.want).MatchString(lines[len(lines)-1]) {
+				t.Errorf("logged %q, want %s", buf, tt.want)
+			}
+		})
+	}
+
+	// the user is logged, not the password
+	buf := captureLog(t)
+	r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+	r.SetBasicAuth("alice", "secret")
+	send(AccessLog(okHandler, false), r)
+	if !strings.Contains(buf.String(), " - alice [") || strings.Contains(buf.String(), "secret") {
+		t.Errorf("logged %q", buf)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		header  []string
+		code    int
+		allowed string // Access-Control-Allow-Methods, only of preflights
+	}{
+		{"request", "*", http.MethodGet, []string{"Origin", "https://app.example.com"}, http.StatusOK, ""},
+		{"preflight", "*", http.MethodOptions, []string{"Origin", "https://app.example.com", "Access-Control-Request-Method", "GET", "Access-Control-Request-Headers", "Range"}, http.StatusNoContent, "GET, HEAD, POST, OPTIONS"},
+		{"plain options", "*", http.MethodOptions, nil, http.StatusOK, ""},
+		{"single origin", "https://app.example.com", http.MethodGet, []string{"Origin", "https://app.example.com"}, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(CORS(okHandler, tt.origin), tt.method, "/a.txt", tt.header...)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+
+			h := w.Header()
+			if h.Get("Access-Control-Allow-Origin") != tt.origin {
+				t.Errorf("Access-Control-Allow-Origin %q", h.Get("Access-Control-Allow-Origin"))
+			}
+			if varies := h.Get("Vary") == "Origin"; varies != (tt.origin != "*") {
+				t.Errorf("Vary %q", h.Get("Vary"))
+			}
+			if h.Get("Access-Control-Allow-Methods") != tt.allowed {
+				t.Errorf("Access-Control-Allow-Methods %q", h.Get("Access-Control-Allow-Methods"))
+			}
+			if tt.allowed != "" && (h.Get("Access-Control-Allow-Headers") != "Range" || w.Body.Len() != 0) {
+				t.Errorf("Access-Control-Allow-Headers %q, body %q", h.Get("Access-Control-Allow-Headers"), w.Body)
+			}
+			if tt.allowed == "" && !strings.Contains(h.Get("Access-Control-Expose-Headers"), "Content-Range") {
+				t.Errorf("Access-Control-Expose-Headers %q", h.Get("Access-Control-Expose-Headers"))
+			}
+		})
+	}
+
+	// without the middleware nothing changes
+	if w := request(okHandler, http.MethodGet, "/", "Origin", "https://app.example.com"); w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("CORS headers without CORS")
+	}
+}
+
+// Preflights carry no credentials, they must not be refused.
+func TestCORSBeforeAuth(t *testing.T) {
+	h := CORS(BasicAuth(okHandler, "alice", "secret", nil), "*")
+
+	w := request(h, http.MethodOptions, "/", "Access-Control-Request-Method", "GET")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("preflight: status %d", w.Code)
+	}
+	if w := request(h, http.MethodGet, "/"); w.Code != http.StatusUnauthorized || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("request: status %d, Access-Control-Allow-Origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "0123456789"})))
+
+	tests := []struct {
+		name   string
+		target string
+		header []string
+		status int
+		bytes  int64
+		id     string // sent by the client, generated if empty
+	}{
+		{"file", "/a.txt?x=1", nil, http.StatusOK, 10, ""},
+		{"not found", "/missing", nil, http.StatusNotFound, -1, ""},
+		{"id of proxy", "/a.txt", []string{"X-Request-ID", "proxy-42"}, http.StatusOK, 10, "proxy-42"},
+		{"invalid id", "/a.txt", []string{"X-Request-ID", "bad id\n"}, http.StatusOK, 10, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLog(t)
+			SetLogLevel(LogQuiet)
+			defer SetLogLevel(LogInfo)
+
+			w := request(JSONLog(s), http.MethodGet, tt.target, tt.header...)
+
+			// errors are logged before
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			var e map[string]any
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &e); err != nil {
+				t.Fatalf("%v: %q", err, buf)
+			}
+
+			id := w.Header().Get("X-Request-ID")
+			if tt.id != "" && id != tt.id || tt.id == "" && !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) {
+				t.Errorf("X-Request-ID %q", id)
+			}
+
+			if _, err := time.Parse(time.RFC3339Nano, e["timestamp"].(string)); err != nil {
+				t.Errorf("timestamp: %v", err)
+			}
+			if d, ok := e["duration_ms"].(float64); !ok || d < 0 {
+				t.Errorf("duration_ms %v", e["duration_ms"])
+			}
+			if e["request_id"] != id || e["method"] != "GET" || e["remote_ip"] != "192.0.2.1" || e["path"] != strings.Split(tt.target, "?")[0] || e["status"] != float64(tt.status) {
+				t.Errorf("logged %v", e)
+			}
+			if tt.bytes >= 0 && e["bytes"] != float64(tt.bytes) {
+				t.Errorf("bytes %v, want %d", e["bytes"], tt.bytes)
+			}
+		})
+	}
+}
+
+func TestTrustProxy(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.1/32")
+	_, proxies, _ := net.ParseCIDR("10.1.0.0/16")
+	trusted := []*net.IPNet{proxy, proxies}
+
+	tests := []struct {
+		name   string
+		peer   string
+		header []string
+		want   string // client address the handler sees
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1:1234"},
+		{"spoofed", "192.0.2.1:1234", []string{"X-Forwarded-For", "192.168.1.5"}, "192.0.2.1:1234"},
+		{"spoofed X-Real-IP", "192.0.2.1:1234", []string{"X-Real-IP", "192.168.1.5"}, "192.0.2.1:1234"},
+		{"trusted", "10.0.0.1:1234", []string{"X-Forwarded-For", "192.0.2.7"}, "192.0.2.7:1234"},
+		{"X-Real-IP", "10.0.0.1:1234", []string{"X-Real-IP", "192.0.2.7"}, "192.0.2.7:1234"},
+		{"IPv6", "10.0.0.1:1234", []string{"X-Forwarded-For", "2001:db8::1"}, "[2001:db8::1]:1234"},
+		{"without headers", "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"invalid", "10.0.0.1:1234", []string{"X-Forwarded-For", "unknown"}, "10.0.0.1:1234"},
+		// what the client sent is left of the last untrusted hop
+		{"forged hop", "10.0.0.1:1234", []string{"X-Forwarded-For", "192.168.1.5, 192.0.2.7"}, "192.0.2.7:1234"},
+		{"chain of proxies", "10.0.0.1:1234", []string{"X-Forwarded-For", "192.168.1.5, 192.0.2.7, 10.1.2.3"}, "192.0.2.7:1234"},
+		{"only proxies", "10.0.0.1:1234", []string{"X-Forwarded-For", "10.1.2.3"}, "10.1.2.3:1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := TrustProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}), trusted)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			send(h, r, tt.header...)
+			if got != tt.want {
+				t.Errorf("RemoteAddr %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Behind TrustProxy, allowed networks and the access log see the
+// client, unless the headers were not sent by a trusted proxy.
+func TestTrustProxyAllowNets(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.1/32")
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	h := TrustProxy(AccessLog(AllowNets(okHandler, []*net.IPNet{lan}), false), []*net.IPNet{proxy})
+
+	tests := []struct {
+		name string
+		peer string
+		xff  string
+		code int
+		log  string
+	}{
+		{"client", "10.0.0.1:1234", "192.168.1.5", http.StatusOK, "192.168.1.5 "},
+		{"other client", "10.0.0.1:1234", "192.0.2.7", http.StatusForbidden, "192.0.2.7 "},
+		{"spoofed", "192.0.2.7:1234", "192.168.1.5", http.StatusForbidden, "192.0.2.7 "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLog(t)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			if w := send(h, r, "X-Forwarded-For", tt.xff); w.Code != tt.code {
+				t.Errorf("status %d, want %d", w.Code, tt.code)
+			}
+
+			// refusals are logged before
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if !strings.HasPrefix(lines[len(lines)-1], tt.log) {
+				t.Errorf("logged %q, want prefix %q", buf, tt.log)
+			}
+		})
+	}
+}
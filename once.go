@@ -0,0 +1,164 @@
+package sharedir
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// State of a server that stops serving files after the first
+// complete download. Only one download can be in progress, so
+// that concurrent requests can't get the file a second time.
+type oneShot struct {
+	mu     sync.Mutex
+	busy   bool          // a download is in progress
+	served chan struct{} // closed after the first complete download
+}
+
+func newOneShot() *oneShot {
+	return &oneShot{served: make(chan struct{})}
+}
+
+// Claim the download. Returns the status code to fail the
+// request with if it can't be served.
+func (o *oneShot) start() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	select {
+	case <-o.served:
+		return http.StatusGone
+	default:
+	}
+	if o.busy {
+		return http.StatusServiceUnavailable
+	}
+	o.busy = true
+	return http.StatusOK
+}
+
+// Give up the download, marking the file as served if it was
+// sent completely. The file can be served again otherwise.
+func (o *oneShot) end(complete bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.busy = false
+	if complete {
+		close(o.served)
+	}
+}
+
+// Channel that is closed once the file was downloaded completely
+// in one-shot mode (Config.Once), nil otherwise.
+func (s *Server) Served() <-chan struct{} {
+	if s.once == nil {
+		return nil
+	}
+	return s.once.served
+}
+
+// Serve file p once to the first client that downloads it
+// completely. Ranges are ignored, so that a download can't be
+// assembled from several requests without being noticed.
+func (s *Server) serveOnce(w http.ResponseWriter, r *http.Request, p *safePath) {
+	w = noRangesWriter{w}
+
+	if r.Method == http.MethodHead {
+		s.serveFile(w, r, p)
+		return
+	}
+
+	if code := s.once.start(); code != http.StatusOK {
+		serveFailure(w, r, code, http.StatusText(code))
+		return
+	}
+
+	r.Header.Del("Range")
+	sw := &statusWriter{ResponseWriter: w}
+	s.serveFile(sw, r, p)
+
+	inf, err := fs.Stat(p.fsys, p.name)
+	complete := err == nil && sw.status == http.StatusOK && sw.size == inf.Size() && r.Context().Err() == nil
+	s.once.end(complete)
+
+	if complete {
+		infof("     file was downloaded, it's not served anymore")
+	}
+}
+
+// Response writer that tells clients that ranges are not served,
+// replacing the header set by http.ServeContent.
+type noRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (w noRangesWriter) WriteHeader(code int) {
+	w.Header().Set("Accept-Ranges", "none")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Allow http.ResponseController to access the original writer.
+func (w noRangesWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// File system with only the file at path, for sharing it
+// without the other files of its directory.
+type fileFS struct {
+	dir  fs.FS  // directory of the file
+	name string // base name of the file
+}
+
+// File system with only the file at path, e.g. for Config.FS in
+// one-shot mode.
+func FileFS(path string) fs.FS {
+	return fileFS{dir: os.DirFS(filepath.Dir(path)), name: filepath.Base(path)}
+}
+
+func (f fileFS) Open(name string) (fs.File, error) {
+	switch name {
+	case ".":
+		d, err := f.dir.Open(".")
+		if err != nil {
+			return nil, err
+		}
+		return &fileFSDir{File: d, fsys: f}, nil
+	case f.name:
+		return f.dir.Open(name)
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f fileFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	inf, err := fs.Stat(f.dir, f.name)
+	if err != nil {
+		return nil, err
+	}
+	return []fs.DirEntry{fs.FileInfoToDirEntry(inf)}, nil
+}
+
+// The directory of fileFS, listing only its file.
+type fileFSDir struct {
+	fs.File
+	fsys fileFS
+	read bool // entries were returned by ReadDir
+}
+
+func (d *fileFSDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.read {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	return d.fsys.ReadDir(".")
+}
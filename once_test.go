@@ -0,0 +1,134 @@
+package sharedir
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOnce(t *testing.T) {
+	dir := testDir(t, map[string]string{"file.txt": "0123456789", "other.txt": "o"})
+	cfg := DefaultConfig()
+	cfg.Once = true
+	cfg.FS = FileFS(filepath.Join(dir, "file.txt"))
+	s := testServer(t, cfg)
+
+	served := func() bool {
+		select {
+		case <-s.Served():
+			return true
+		default:
+			return false
+		}
+	}
+
+	// only the file is shared
+	if got := listingNames(t, s, "/"); !slices.Equal(got, []string{"file.txt"}) {
+		t.Errorf("listing %q", got)
+	}
+	if w := request(s, http.MethodGet, "/other.txt"); w.Code != http.StatusNotFound {
+		t.Errorf("other file: status %d", w.Code)
+	}
+
+	// neither counts as download
+	if w := request(s, http.MethodHead, "/file.txt"); w.Code != http.StatusOK || served() {
+		t.Fatalf("HEAD: status %d, served %t", w.Code, served())
+	}
+	w := request(s, http.MethodGet, "/file.txt", "Range", "bytes=0-3")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Accept-Ranges") != "none" {
+		t.Fatalf("range: status %d, body %q, Accept-Ranges %q", w.Code, w.Body, w.Header().Get("Accept-Ranges"))
+	}
+	if !served() {
+		t.Fatal("not served after complete download")
+	}
+
+	if w := request(s, http.MethodGet, "/file.txt"); w.Code != http.StatusGone {
+		t.Errorf("second download: status %d", w.Code)
+	}
+}
+
+// The file is downloaded only once as the index file of the
+// directory as well.
+func TestOnceIndex(t *testing.T) {
+	dir := testDir(t, map[string]string{"index.html": "<p>hi</p>"})
+	cfg := DefaultConfig()
+	cfg.Once = true
+	cfg.IndexFile = "index.html"
+	cfg.FS = FileFS(filepath.Join(dir, "index.html"))
+	s := testServer(t, cfg)
+
+	if w := request(s, http.MethodGet, "/"); w.Code != http.StatusOK || w.Body.String() != "<p>hi</p>" {
+		t.Fatalf("status %d, body %q", w.Code, w.Body)
+	}
+	select {
+	case <-s.Served():
+	default:
+		t.Fatal("not served after complete download")
+	}
+
+	for _, target := range []string{"/", "/index.html"} {
+		if w := request(s, http.MethodGet, target); w.Code != http.StatusGone {
+			t.Errorf("%s: status %d", target, w.Code)
+		}
+	}
+}
+
+// While the file is downloaded, others can't start downloading
+// it, and a download that fails doesn't count.
+func TestOnceConcurrent(t *testing.T) {
+	dir := testDir(t, map[string]string{"file.txt": "content"})
+	cfg := DefaultConfig()
+	cfg.Once = true
+	cfg.FS = FileFS(filepath.Join(dir, "file.txt"))
+	s := testServer(t, cfg)
+
+	bw := &blockingWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	r := httptest.NewRequest(http.MethodGet, "/file.txt", nil)
+	done := make(chan struct{})
+	go func() {
+		s.ServeHTTP(bw, r)
+		close(done)
+	}()
+	<-bw.writing
+
+	if w := request(s, http.MethodGet, "/file.txt"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("concurrent: status %d", w.Code)
+	}
+
+	close(bw.release)
+	<-done
+	select {
+	case <-s.Served():
+	default:
+		t.Fatal("not served")
+	}
+	if w := request(s, http.MethodGet, "/file.txt"); w.Code != http.StatusGone {
+		t.Errorf("after: status %d", w.Code)
+	}
+}
+
+func TestOnceIncomplete(t *testing.T) {
+	dir := testDir(t, map[string]string{"file.txt": "content"})
+	cfg := DefaultConfig()
+	cfg.Once = true
+	cfg.FS = FileFS(filepath.Join(dir, "file.txt"))
+	s := testServer(t, cfg)
+
+	// as if the client went away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/file.txt", nil).WithContext(ctx)
+	send(s, r)
+
+	select {
+	case <-s.Served():
+		t.Fatal("served after canceled download")
+	default:
+	}
+	if w := request(s, http.MethodGet, "/file.txt"); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("retry: status %d, body %q", w.Code, w.Body)
+	}
+}
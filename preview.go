@@ -0,0 +1,114 @@
+package sharedir
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Source code extensions that the system MIME table usually
+// doesn't know as text.
+var previewExts = []string{
+	".c", ".h", ".cc", ".cpp", ".hpp", ".rs", ".py", ".rb", ".java",
+	".kt", ".sh", ".bash", ".zsh", ".pl", ".lua", ".sql", ".yaml",
+	".yml", ".toml", ".ini", ".conf", ".cfg", ".mod", ".sum",
+}
+
+// Page with the lines of a text file, numbered with CSS, so that
+// they are not copied together with the text.
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<title>sharedir: {{ .Name }}</title>
+		<link rel="icon" type="image/x-icon" href="{{ .Prefix }}/~favicon.ico">
+		<style type="text/css">
+			html * { color: #323232 !important; }
+			pre { counter-reset: line; }
+			pre span { display: block; }
+			pre span::before {
+				counter-increment: line;
+				content: counter(line);
+				display: inline-block;
+				width: 4em;
+				margin-right: 1em;
+				text-align: right;
+				color: #999 !important;
+				user-select: none;
+			}
+		</style>
+	</head>
+	<body>
+		<h2>{{ .Name }}</h2>
+		<small><a href="?raw=1">view raw</a> <a href="?download=1">download</a></small>
+		<pre>
+		{{- range .Lines }}<span>{{ . }}</span>{{ end -}}
+		</pre>
+	</body>
+</html>
+`))
+
+// Check if file name looks like text or source code. HTML files
+// are displayed by the browser as usual.
+func (s *Server) previewable(name string) bool {
+	mimet, _ := s.guessMimeType(name, nil)
+
+	if strings.HasPrefix(mimet, "text/html") {
+		return false
+	}
+
+	return strings.HasPrefix(mimet, "text/") ||
+		strings.HasPrefix(mimet, "application/json") ||
+		strings.HasPrefix(mimet, "application/javascript") ||
+		strings.HasPrefix(mimet, "application/xml") ||
+		slices.Contains(previewExts, strings.ToLower(filepath.Ext(name)))
+}
+
+// Serve text file f as HTML page with numbered lines. Returns
+// false without writing a response if the content is not text
+// (e.g. wrong extension), f is then rewound.
+func servePreview(w http.ResponseWriter, r *http.Request, f io.ReadSeeker, inf os.FileInfo) bool {
+	var buf bytes.Buffer
+
+	src, err := io.ReadAll(f)
+	if err != nil {
+		log.Printf("     read file [%s]: %v", inf.Name(), err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return true
+	}
+
+	if bytes.IndexByte(src, 0) >= 0 || !utf8.Valid(src) {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			log.Printf("     seek file [%s]: %v", inf.Name(), err)
+			serveFailure(w, r, http.StatusInternalServerError, "server error")
+			return true
+		}
+		return false
+	}
+
+	text := strings.TrimSuffix(strings.ReplaceAll(string(src), "\r\n", "\n"), "\n")
+
+	err = previewPage.Execute(&buf, struct {
+		Name   string
+		Lines  []string
+		Prefix string
+	}{inf.Name(), strings.Split(text, "\n"), linkPrefix(r)})
+	if err != nil {
+		log.Printf("     execute preview page: %v", err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+	http.ServeContent(w, r, inf.Name(), inf.ModTime(), bytes.NewReader(buf.Bytes()))
+	infof("     served preview of file of %d bytes", inf.Size())
+	return true
+}
@@ -0,0 +1,65 @@
+package sharedir
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServePreview(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"main.go":   "package main\n\nfunc main() { println(\"<b>&\") }\n",
+		"notes.txt": "one\r\ntwo\r\n",
+		"x.py":      "print(1)\n",
+		"page.html": "<p>html</p>",
+		"image.png": "\x89PNG\r\n\x1a\n\x00\x00",
+		"bin.c":     "int\x00main",
+	})
+
+	tests := []struct {
+		name    string
+		target  string
+		accept  string
+		preview bool     // served as preview page
+		lines   []string // of the preview
+	}{
+		{"source", "/main.go", "text/html", true, []string{"<span>package main</span>", "<span></span>", "<span>func main() { println(&#34;&lt;b&gt;&amp;&#34;) }</span>"}},
+		{"text", "/notes.txt", "text/html", true, []string{"<span>one</span><span>two</span></pre>"}},
+		{"unknown to mime table", "/x.py", "text/html", true, []string{"<span>print(1)</span>"}},
+		{"html", "/page.html", "text/html", false, nil},
+		{"image", "/image.png", "text/html", false, nil},
+		{"binary content", "/bin.c", "text/html", false, nil},
+		{"raw", "/main.go?raw=1", "text/html", false, nil},
+		{"not a browser", "/main.go", "*/*", false, nil},
+	}
+
+	cfg := testConfig(dir)
+	cfg.Preview = true
+	s := testServer(t, cfg)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(s, http.MethodGet, tt.target, "Accept", tt.accept)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+
+			body := w.Body.String()
+			preview := strings.Contains(body, "<pre>")
+			if preview != tt.preview {
+				t.Fatalf("preview %t, body %q", preview, body)
+			}
+			for _, l := range tt.lines {
+				if !strings.Contains(body, l) {
+					t.Errorf("no %q in %q", l, body)
+				}
+			}
+		})
+	}
+
+	// files are served as they are without -preview
+	s = testServer(t, testConfig(dir))
+	if w := request(s, http.MethodGet, "/main.go", "Accept", "text/html"); strings.Contains(w.Body.String(), "<pre>") {
+		t.Error("preview when disabled")
+	}
+}
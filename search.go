@@ -0,0 +1,114 @@
+package sharedir
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	searchResults = 200    // max number of results
+	searchVisits  = 100000 // max number of entries visited
+)
+
+var errSearchDone = errors.New("search done")
+
+// List files and directories whose names contain the "q"
+// query parameter (case-insensitively), like a directory
+// listing. Only shared entries are searched.
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	var (
+		err     error
+		results []fs.DirEntry
+	)
+
+	if s.noListing {
+		serveFailure(w, r, http.StatusForbidden, "listing is disabled")
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		serveFailure(w, r, http.StatusBadRequest, "missing search term")
+		return
+	}
+
+	if results, err = s.search(strings.ToLower(q)); err != nil {
+		log.Printf("     search: %v", err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	infof("     found %d results for '%s'", len(results), q)
+	s.serveListing(w, r, listingData{
+		DirName: "search results for '" + q + "'",
+		Content: results,
+		Search:  true,
+		query:   url.Values{"q": {q}}.Encode(),
+	})
+}
+
+// Walk the shared directories and collect entries matching
+// term, named by their path (as visible to clients). Stops
+// after searchResults matches or searchVisits visited entries.
+func (s *Server) search(term string) ([]fs.DirEntry, error) {
+	var (
+		results []fs.DirEntry
+		visits  int
+	)
+
+	for i := range s.mounts {
+		root := s.rootPath(&s.mounts[i])
+		if protected(root) {
+			continue
+		}
+
+		err := fs.WalkDir(root.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+			// unreadable directories are skipped
+			if err != nil || name == "." {
+				return nil
+			}
+
+			if visits += 1; visits > searchVisits {
+				return errSearchDone
+			}
+
+			if !s.shared(root.child(path.Dir(name)), d) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			// names inside are not revealed without credentials
+			if d.IsDir() && protected(root.child(name)) {
+				return fs.SkipDir
+			}
+
+			if strings.Contains(strings.ToLower(d.Name()), term) {
+				results = append(results, namedEntry{d, root.child(name).rel})
+
+				if len(results) >= searchResults {
+					return errSearchDone
+				}
+			}
+
+			if d.IsDir() && !s.recursive {
+				return fs.SkipDir
+			}
+			return nil
+		})
+
+		if err == errSearchDone {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,83 @@
+package sharedir
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"report.txt":               "",
+		"docs/Annual-Report.pdf":   "",
+		"docs/notes.txt":           "",
+		"docs/old/report-2020.txt": "",
+		"reports/":                 "",
+		".hidden/report.txt":       "",
+		"priv/" + authFile:         "u:p\n",
+		"priv/report-secret.txt":   "",
+		"ignored/report.txt":       "",
+		ignoreFile:                 "ignored\n",
+	})
+	cfg := testConfig(dir)
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"report", []string{"docs/Annual-Report.pdf", "docs/old/report-2020.txt", "report.txt", "reports"}},
+		{"REPORT-2", []string{"docs/old/report-2020.txt"}},
+		{".txt", []string{"docs/notes.txt", "docs/old/report-2020.txt", "report.txt"}},
+		{"nothing", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.q, func(t *testing.T) {
+			got := listingNames(t, s, "/~search?q="+tt.q)
+			for i := range got {
+				got[i] = strings.Trim(got[i], "/")
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("results %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if w := request(s, http.MethodGet, "/~search"); w.Code != http.StatusBadRequest {
+		t.Errorf("no term: status %d", w.Code)
+	}
+
+	w := request(s, http.MethodGet, "/~search?q=notes", "Accept", "text/html")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "docs/notes.txt") {
+		t.Errorf("html: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+// Without recursive mode only the top level is searched.
+func TestSearchNotRecursive(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{
+		"a.txt":     "",
+		"sub/a.txt": "",
+	})))
+
+	if got := listingNames(t, s, "/~search?q=a.txt"); len(got) != 1 || strings.Trim(got[0], "/") != "a.txt" {
+		t.Errorf("results %q", got)
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	files := make(map[string]string)
+	for i := range searchResults + 10 {
+		files[fmt.Sprintf("f%03d.txt", i)] = ""
+	}
+	s := testServer(t, testConfig(testDir(t, files)))
+
+	if got := listingNames(t, s, "/~search?q=f"); len(got) != searchResults {
+		t.Errorf("%d results, want %d", len(got), searchResults)
+	}
+}
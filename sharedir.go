@@ -1,373 +1,2070 @@
-package main
+// Package sharedir shares directories over HTTP, with listings,
+// uploads, archives and access control. Server is an http.Handler,
+// so it can be mounted in other servers; the middleware of this
+// package adds what the sharedir command offers around it, e.g.
+// authentication and rate limits.
+package sharedir
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"html"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/net/webdav"
 )
 
+// Version of this build, can be set with '-ldflags "-X
+// github.com/vgratian/sharedir.Version=v1.2.3"'. Otherwise it is
+// taken from the build info, if available.
+var Version string
+
+// Path of this module, to find its version in the build info.
+const modulePath = "github.com/vgratian/sharedir"
+
+func init() {
+	if Version != "" {
+		return
+	}
+
+	Version = "dev"
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+
+	// the main module, unless imported by another one
+	mod := &bi.Main
+	for _, d := range bi.Deps {
+		if d.Path == modulePath {
+			mod = d
+		}
+	}
+	if v := mod.Version; v != "" && v != "(devel)" {
+		Version = v
+		return
+	}
+	if mod.Path != bi.Main.Path {
+		return
+	}
+
+	var rev, dirty string
+	for _, kv := range bi.Settings {
+		switch kv.Key {
+		case "vcs.revision":
+			rev = kv.Value
+		case "vcs.modified":
+			if kv.Value == "true" {
+				dirty = "-dirty"
+			}
+		}
+	}
+	if rev != "" {
+		Version = "dev-" + rev[:min(len(rev), 12)] + dirty
+	}
+}
+
 const (
 	templateFp    = "template.html"
-	compressQuery = "?download=zip"
-)
+	compressQuery = "?download=zip" // appended to directory links
 
-var (
-	root      string         // root of shared directory
-	recursive bool   = false // recursive mode
-	home      string         // home directory of program
+	pageSize  = 500     // default number of entries per page of listings
+	renderMax = 4 << 20 // larger files are not rendered as HTML pages
+
+	listingsCached = 64 // number of rendered listings kept in memory
+
+	fsMountName = "share" // name of Config.FS, e.g. of its zip archive
 )
 
+// favicon, embedded so that the binary can be moved alone
+//
+//go:embed sharedir.ico
+var icon []byte
+
+// listing template, embedded for the same reason
+//
+//go:embed template.html
+var templateFS embed.FS
+
+// Options of a Server. The zero value shares nothing, start
+// from DefaultConfig to get the defaults of the command line.
+type Config struct {
+	Dirs           []string          // directories to share, each under its base name if several, or as 'name=path'
+	FS             fs.FS             // shared instead of Dirs if set, e.g. an embed.FS
+	Recursive      bool              // also share subdirectories
+	Hidden         bool              // share hidden files (dotfiles)
+	FollowSymlinks bool              // follow symlinks that stay inside the directory
+	Upload         bool              // accept uploads into shared directories
+	WebDAV         bool              // read-only WebDAV access under davPrefix ("/dav")
+	Markdown       bool              // render Markdown files for browsers
+	Preview        bool              // show text files as HTML pages for browsers
+	Thumbnails     bool              // show thumbnails of images in listings
+	Extensions     []string          // only share files with these extensions, if any
+	NoExtensions   []string          // never share files with these extensions
+	MaxDepth       int               // levels of subdirectories shared in recursive mode, -1 if unlimited
+	IndexFile      string            // served instead of the listing, if present
+	MimeTypes      map[string]string // MIME-types by extension, e.g. ".md"
+	Template       string            // listing template file, the built-in one if empty
+	Prefix         string            // URL path the server is reachable under, e.g. "/share"
+	BaseURL        string            // absolute URL of the share, e.g. behind a reverse proxy
+	TrustedProxies []*net.IPNet      // proxies whose X-Forwarded-Proto and -Host are honored, see TrustProxy
+	MaxTransfers   int               // concurrent file transfers, 0 if unlimited
+	BandwidthLimit int64             // bytes per second of each transfer, 0 if unlimited
+	MaxSize        int64             // larger files are not shared, 0 if unlimited
+	CacheListings  bool              // keep rendered listings until directories change
+	NoListing      bool              // refuse listings, only files with known paths are served
+	IgnoreCase     bool              // if a path isn't found, match its last component ignoring case
+	Manifest       bool              // list all shared files as JSON under manifestPrefix
+	Live           bool              // listings reload on changes, via events under eventsPrefix
+	Secret         string            // key to sign links to files with, none if empty
+	SecretTTL      time.Duration     // signed links in listings expire after it, never if 0
+	SignedOnly     bool              // serve files only via signed links, needs Secret
+	Once           bool              // stop serving files after the first complete download, see Server.Served
+}
+
+// Default options, as without any command-line options.
+func DefaultConfig() Config {
+	return Config{
+		Dirs:      []string{"."},
+		MaxDepth:  -1,
+		IndexFile: "index.html",
+		MimeTypes: make(map[string]string),
+	}
+}
+
+// Server shares directories over HTTP. Its fields are set by
+// NewServer and only read afterwards, so requests can be served
+// concurrently.
+type Server struct {
+	listing *template.Template  // parsed listing template
+	thumbs  *lruCache[[]byte]   // recently generated thumbnails
+	stats   *downloadStats      // number of downloads of each file
+	auths   *lruCache[*dirAuth] // parsed auth files of directories
+	prefix  string              // URL path prefix, without trailing slash
+	started time.Time           // time the server was created
+
+	// absolute URL of the share without trailing slash, derived
+	// from requests if empty
+	baseURL string
+	trusted []*net.IPNet // proxies whose X-Forwarded-* headers are honored
+
+	// rendered listings by path and query, nil if not cached
+	listings *lruCache[cachedListing]
+
+	// chunked uploads in progress, by target and size, nil
+	// unless uploads are accepted
+	partials *partialUploads
+
+	// state of one-shot mode, nil unless enabled
+	once *oneShot
+
+	// closed by Close, ends event streams
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	// watches directories of event streams, nil unless live
+	watcher *dirWatcher
+
+	// read-only WebDAV access under davPrefix, nil unless enabled
+	dav *webdav.Handler
+
+	// signs links to files, nil unless a secret is given
+	signer     *urlSigner
+	signedOnly bool // files are only served via signed links
+
+	// semaphore of active file transfers, nil if unlimited
+	transfers chan struct{}
+	bwlimit   int64 // bytes per second of each transfer, 0 if unlimited
+	maxSize   int64 // larger files are not shared, 0 if unlimited
+
+	mounts    []mount  // shared directories
+	recursive bool     // recursive mode
+	hidden    bool     // share hidden files (dotfiles)
+	symlinks  bool     // follow symlinks that stay inside root
+	upload    bool     // accept uploads into shared directories
+	noListing bool     // refuse listings, search and archives
+	foldCase  bool     // match the last component of paths ignoring case
+	manifest  bool     // list all shared files under manifestPrefix
+	live      bool     // send events on changes of directories
+	markdown  bool     // render Markdown files for browsers
+	preview   bool     // show text files as HTML pages for browsers
+	thumbnail bool     // show thumbnails of images in listings
+	extAllow  []string // only share files with these extensions, if any
+	extBlock  []string // never share files with these extensions
+	maxDepth  int      // levels of subdirectories shared in recursive mode, -1 if unlimited
+	indexFile string   // served instead of the listing, if present
+
+	// MIME-types by extension, take precedence over the system table
+	mimeTypes map[string]string
+}
+
+// Create server with the given options. Fails if one of the
+// directories can't be resolved or the template can't be parsed.
+func NewServer(cfg Config) (*Server, error) {
+	var err error
+
+	s := &Server{
+		thumbs:    newLRUCache[[]byte](thumbCached),
+		stats:     newDownloadStats(),
+		auths:     newLRUCache[*dirAuth](authCached),
+		started:   time.Now(),
+		recursive: cfg.Recursive,
+		hidden:    cfg.Hidden,
+		symlinks:  cfg.FollowSymlinks,
+		upload:    cfg.Upload,
+		noListing: cfg.NoListing,
+		foldCase:  cfg.IgnoreCase,
+		manifest:  cfg.Manifest,
+		live:      cfg.Live,
+		quit:      make(chan struct{}),
+		markdown:  cfg.Markdown,
+		preview:   cfg.Preview,
+		thumbnail: cfg.Thumbnails,
+		extAllow:  cfg.Extensions,
+		extBlock:  cfg.NoExtensions,
+		maxDepth:  cfg.MaxDepth,
+		indexFile: cfg.IndexFile,
+		mimeTypes: make(map[string]string),
+		prefix:    cleanPrefix(cfg.Prefix),
+		trusted:   cfg.TrustedProxies,
+		bwlimit:   cfg.BandwidthLimit,
+		maxSize:   cfg.MaxSize,
+	}
+
+	if cfg.BaseURL != "" {
+		if s.baseURL, err = cleanBaseURL(cfg.BaseURL); err != nil {
+			return nil, fmt.Errorf("base URL: %w", err)
+		}
+	}
+
+	if cfg.CacheListings {
+		s.listings = newLRUCache[cachedListing](listingsCached)
+	}
+
+	if cfg.Once {
+		s.once = newOneShot()
+	}
+
+	if cfg.Secret != "" {
+		s.signer = &urlSigner{key: []byte(cfg.Secret), ttl: cfg.SecretTTL}
+	} else if cfg.SignedOnly {
+		return nil, errors.New("serving files only via signed links needs a secret")
+	}
+	s.signedOnly = cfg.SignedOnly
+
+	if cfg.MaxTransfers > 0 {
+		s.transfers = make(chan struct{}, cfg.MaxTransfers)
+	}
+
+	for ext, mimet := range cfg.MimeTypes {
+		s.mimeTypes[strings.ToLower(ext)] = mimet
+	}
+
+	if cfg.FS != nil {
+		// there are no paths on disk, the root is only used to
+		// build paths within the file system
+		cfg.Dirs = nil
+		s.mounts = append(s.mounts, mount{
+			name: fsMountName,
+			root: string(filepath.Separator) + fsMountName,
+			fsys: cfg.FS,
+		})
+		if s.upload {
+			return nil, errors.New("can't upload into a file system that is not a directory")
+		}
+	}
+
+	for _, d := range cfg.Dirs {
+		var m mount
+
+		m.name, d = splitMount(d)
+		if m.name == "." || m.name == ".." || strings.HasPrefix(m.name, "~") {
+			return nil, fmt.Errorf("invalid name '%s' for [%s]", m.name, d)
+		}
+
+		// convert to absolute path (helps to make sure we don't share anything outside)
+		if m.root, err = filepath.Abs(d); err != nil {
+			return nil, err
+		}
+
+		// symlinks inside root are compared against the real path
+		if m.root, err = filepath.EvalSymlinks(m.root); err != nil {
+			return nil, err
+		}
+
+		if m.name == "" {
+			m.name = filepath.Base(m.root)
+		}
+		m.fsys, m.local = os.DirFS(m.root), true
+
+		for _, o := range s.mounts {
+			if o.name == m.name {
+				return nil, fmt.Errorf("can't share [%s] and [%s] under the same name '%s'", o.root, m.root, m.name)
+			}
+		}
+		s.mounts = append(s.mounts, m)
+	}
+
+	if len(s.mounts) == 0 {
+		return nil, errors.New("no directory to share")
+	}
+
+	if cfg.WebDAV {
+		for _, m := range s.mounts {
+			if len(s.mounts) > 1 && "/"+m.name == davPrefix {
+				return nil, fmt.Errorf("can't share [%s] as '%s' with WebDAV, give it another name", m.root, m.name)
+			}
+		}
+		s.dav = s.newDAVHandler()
+	}
+
+	for i := range s.mounts {
+		if s.mounts[i].ignore, err = readIgnore(s.mounts[i].fsys); err != nil {
+			return nil, fmt.Errorf("read %s of [%s]: %w", ignoreFile, s.mounts[i].root, err)
+		}
+	}
+
+	if s.listing, err = parseTemplate(cfg.Template); err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+
+	if s.upload {
+		if s.partials, err = newPartialUploads(); err != nil {
+			return nil, fmt.Errorf("partial uploads: %w", err)
+		}
+	}
+
+	if s.live {
+		if s.watcher, err = newDirWatcher(); err != nil {
+			return nil, fmt.Errorf("watch directories: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// Split directory argument of the form 'name=path'. The name is
+// empty if not given. Paths containing '=' can still be shared
+// by giving them with a slash before it (e.g. './a=b').
+func splitMount(d string) (name, dir string) {
+	if n, p, ok := strings.Cut(d, "="); ok && n != "" && !strings.ContainsAny(n, `/\`) {
+		return n, p
+	}
+	return "", d
+}
+
+// Normalize URL path prefix to have a leading slash and no
+// trailing slash, "/" becomes empty.
+func cleanPrefix(p string) string {
+	if p = strings.Trim(p, "/"); p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// Key of the URL path prefix in the request context, needed
+// for links of pages that are not rendered by the Server.
+type prefixKey struct{}
+
+// URL path prefix of the server that handles r.
+func linkPrefix(r *http.Request) string {
+	p, _ := r.Context().Value(prefixKey{}).(string)
+	return p
+}
+
+// Check that u is an absolute HTTP(S) URL and remove its
+// trailing slash.
+func cleanBaseURL(u string) (string, error) {
+	p, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if p.Scheme != "http" && p.Scheme != "https" || p.Host == "" {
+		return "", errors.New("must be an absolute http or https URL")
+	}
+	if p.RawQuery != "" || p.Fragment != "" {
+		return "", errors.New("must not have a query or fragment")
+	}
+	return strings.TrimSuffix(p.String(), "/"), nil
+}
+
+// Absolute URL of the (escaped) path p below the prefix. Without
+// a base URL, it is built from the request, with the scheme and
+// host given by a reverse proxy in X-Forwarded-Proto and
+// X-Forwarded-Host if present. These are only honored from the
+// proxies in Config.TrustedProxies, anyone else could make links
+// point to another host.
+func (s *Server) absURL(r *http.Request, p string) string {
+	if s.baseURL != "" {
+		return s.baseURL + p
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if ip := peerIP(r); ip != nil && inNets(ip, s.trusted) {
+		if v, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ","); v != "" {
+			scheme = strings.ToLower(strings.TrimSpace(v))
+		}
+		if v, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ","); v != "" {
+			host = strings.TrimSpace(v)
+		}
+	}
+
+	return scheme + "://" + host + s.prefix + p
+}
+
+// Create handler sharing directories with the given options,
+// e.g. to mount it in another mux. Panics if NewServer fails.
+func NewHandler(cfg Config) http.Handler {
+	s, err := NewServer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// URL path prefix of the server, without trailing slash.
+func (s *Server) Prefix() string {
+	return s.prefix
+}
+
+// Absolute URL of the share (Config.BaseURL), without trailing
+// slash. Empty if not given.
+func (s *Server) BaseURL() string {
+	return s.baseURL
+}
+
+// Shared directory, as seen by clients.
+type SharedDir struct {
+	Name string // name of the directory in URLs, if several are shared
+	Path string // absolute path of the directory
+}
+
+// Directories shared by the server, in the order given.
+func (s *Server) Dirs() []SharedDir {
+	var dirs []SharedDir
+	for _, m := range s.mounts {
+		dirs = append(dirs, SharedDir{Name: m.name, Path: m.root})
+	}
+	return dirs
+}
+
+// Check that the shared directories can be read, which is
+// otherwise only noticed when serving.
+func (s *Server) Check() error {
+	for _, m := range s.mounts {
+		if _, err := fs.ReadDir(m.fsys, "."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A shared directory. If only one directory is shared, it is
+// served at "/", otherwise each is served under its name.
+type mount struct {
+	name  string // name visible to clients
+	root  string // absolute path of the directory
+	fsys  fs.FS  // files of the directory, read through it
+	local bool   // fsys is the directory on disk (root exists)
+
+	ignore ignoreList // rules of the ignore file, if any
+}
+
 type safePath struct {
 	abs      string // absolute path (unvisible to clients)
 	rel      string // path relative to root (visible)
+	root     string // root of the mount, empty for the list of mounts
+	name     string // path in fsys, "." for the root
+	fsys     fs.FS  // file system of the mount
+	local    bool   // abs is on disk, e.g. symlinks can be checked
+	hidden   bool   // path is or is inside a hidden file (dotfile)
 	compress bool
+
+	ignore ignoreList // rules of the ignore file of the mount
+}
+
+// Path of the root of mount m.
+func (s *Server) rootPath(m *mount) *safePath {
+	sp := &safePath{abs: m.root, root: m.root, name: ".", fsys: m.fsys, local: m.local, ignore: m.ignore}
+	if len(s.mounts) > 1 {
+		sp.rel = m.name
+	}
+	return sp
+}
+
+// Path of the slash-separated, clean path sub within sp.
+func (sp *safePath) child(sub string) *safePath {
+	if sub == "." {
+		return sp
+	}
+
+	c := *sp
+	c.abs = filepath.Join(sp.abs, filepath.FromSlash(sub))
+	c.rel = strings.TrimPrefix(sp.rel+"/"+sub, "/")
+	c.name = path.Join(sp.name, sub)
+	c.compress = false
+
+	for _, n := range strings.Split(sub, "/") {
+		c.hidden = c.hidden || isHidden(n)
+	}
+	return &c
+}
+
+// Find the mount that the raw path (without leading slash)
+// belongs to and return it together with the remainder of the
+// path. Returns nil if the path matches none of the mounts or
+// if it is the top-level list of mounts.
+func (s *Server) findMount(raw string) (*mount, string) {
+	var name, rest string
+
+	if len(s.mounts) == 1 {
+		return &s.mounts[0], raw
+	}
+
+	name, rest, _ = strings.Cut(raw, "/")
+	for i := range s.mounts {
+		if s.mounts[i].name == name {
+			return &s.mounts[i], rest
+		}
+	}
+
+	return nil, ""
+}
+
+// Check if the requested path (decoded, without query) is admissible. If so, return
+// a safePath instance. Path is admissible if it is
+// valid and a subpath of the root of one of the mounts.
+// Symlinks and non-regular files are checked separately.
+func (s *Server) parseSafePath(raw string) *safePath {
+	var (
+		sp  *safePath
+		m   *mount
+		abs string
+		sub = "."
+	)
+
+	// path might contain "..", but the root check below is
+	// done after cleaning it
+	raw = strings.TrimPrefix(raw, "/")
+
+	if raw == "" && len(s.mounts) > 1 {
+		// top-level list of mounts, not backed by a directory
+		return new(safePath)
+	}
+
+	if m, raw = s.findMount(raw); m == nil {
+		log.Print("     no such mount")
+		return nil
+	}
+
+	// root is absolute, so is the joined (and cleaned) path
+	abs = filepath.Join(m.root, raw)
+
+	if !inRoot(abs, m.root) {
+		log.Print("     not in root")
+		return nil
+	}
+
+	if abs != m.root {
+		sub = strings.TrimPrefix(abs, strings.TrimSuffix(m.root, string(os.PathSeparator))+string(os.PathSeparator))
+		sub = filepath.ToSlash(sub)
+	}
+
+	// the mount name, if added to rel, is not hidden
+	sp = s.rootPath(m).child(sub)
+
+	debugf("     resolved to [%s]", sp.abs)
+
+	return sp
+}
+
+// Check if path is root or inside root.
+func inRoot(path, root string) bool {
+	// compare on path boundaries, so that a sibling like
+	// "/srv/shared-secret" doesn't pass for root "/srv/shared"
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(os.PathSeparator))+string(os.PathSeparator))
+}
+
+// Check if path can be served with regard to symlinks. By
+// default, paths going through symlinks are refused. If we
+// follow symlinks, they still need to resolve inside root.
+// Paths that can't be resolved (e.g. don't exist) are not
+// refused here.
+func (s *Server) symlinkSafe(path, root string) bool {
+	real, err := filepath.EvalSymlinks(path)
+
+	if err != nil || real == path {
+		return true
+	}
+
+	debugf("     symlink [%s] resolves to [%s]", path, real)
+	return s.symlinks && inRoot(real, root)
+}
+
+// Check if directory dir is within the maximum depth below
+// root, e.g. "root/a/b" has depth 2.
+func (s *Server) depthShared(dir, root string) bool {
+	if s.maxDepth < 0 || dir == root {
+		return true
+	}
+
+	rel := strings.TrimPrefix(dir, strings.TrimSuffix(root, string(os.PathSeparator))+string(os.PathSeparator))
+	return strings.Count(rel, string(os.PathSeparator))+1 <= s.maxDepth
+}
+
+// Check if file is shared according to the allowed and blocked
+// extensions (compared case-insensitively).
+func (s *Server) extShared(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	if len(s.extAllow) > 0 && !slices.Contains(s.extAllow, ext) {
+		return false
+	}
+	return !slices.Contains(s.extBlock, ext)
+}
+
+// Check if a file should be hidden by default, i.e. if
+// it's a dotfile.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// Check if entry of directory dir can be listed and served,
+// i.e. if it isn't hidden, a refused symlink or a non-regular
+// file.
+func (s *Server) shared(dir *safePath, e os.DirEntry) bool {
+	if (isHidden(e.Name()) && !s.hidden) || strings.EqualFold(e.Name(), authFile) {
+		return false
+	}
+
+	p := dir.child(e.Name())
+
+	mode := e.Type()
+	if mode&fs.ModeSymlink != 0 {
+		// only symlinks on disk can be resolved and checked
+		if !p.local || !s.symlinkSafe(p.abs, p.root) {
+			return false
+		}
+		// type of the target
+		inf, err := fs.Stat(p.fsys, p.name)
+		if err != nil {
+			return false
+		}
+		mode = inf.Mode()
+	}
+
+	if p.ignore.ignored(p.name, mode.IsDir()) {
+		return false
+	}
+
+	if mode.IsDir() {
+		return s.depthShared(p.abs, p.root)
+	}
+
+	// devices, sockets, fifos, etc. can't be served
+	if !mode.IsRegular() || !s.extShared(e.Name()) {
+		return false
+	}
+
+	if s.maxSize > 0 {
+		inf, err := fs.Stat(p.fsys, p.name)
+		return err == nil && inf.Size() <= s.maxSize
+	}
+	return true
+}
+
+// Remove entries of directory dir that are not shared.
+func (s *Server) filterEntries(dir *safePath, entries []os.DirEntry) []os.DirEntry {
+	var visible []os.DirEntry
+
+	for _, e := range entries {
+		if s.shared(dir, e) {
+			visible = append(visible, e)
+		}
+	}
+	return visible
+}
+
+// MIME-types of extensions common in source trees, which the
+// system table lacks or maps to types browsers download. Used
+// unless overridden with '-mime'.
+var builtinMimeTypes = map[string]string{
+	".md":          "text/markdown; charset=utf-8",
+	".markdown":    "text/markdown; charset=utf-8",
+	".log":         "text/plain; charset=utf-8",
+	".go":          "text/plain; charset=utf-8",
+	".mod":         "text/plain; charset=utf-8",
+	".sum":         "text/plain; charset=utf-8",
+	".rs":          "text/plain; charset=utf-8",
+	".py":          "text/plain; charset=utf-8",
+	".rb":          "text/plain; charset=utf-8",
+	".c":           "text/plain; charset=utf-8",
+	".h":           "text/plain; charset=utf-8",
+	".cpp":         "text/plain; charset=utf-8",
+	".hpp":         "text/plain; charset=utf-8",
+	".java":        "text/plain; charset=utf-8",
+	".kt":          "text/plain; charset=utf-8",
+	".sh":          "text/plain; charset=utf-8",
+	".sql":         "text/plain; charset=utf-8",
+	".proto":       "text/plain; charset=utf-8",
+	".diff":        "text/plain; charset=utf-8",
+	".patch":       "text/plain; charset=utf-8",
+	".ini":         "text/plain; charset=utf-8",
+	".conf":        "text/plain; charset=utf-8",
+	".toml":        "text/plain; charset=utf-8",
+	".yaml":        "text/plain; charset=utf-8",
+	".yml":         "text/plain; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".webmanifest": "application/manifest+json",
+}
+
+// Guess MIME-type of a file, consulting in order:
+//
+//  1. types set with '-mime', by extension
+//  2. builtinMimeTypes, by extension
+//  3. the system table, by extension
+//  4. the first 512 bytes of content, if not nil
+//
+// and otherwise assume 'binary data'. content is rewound after
+// sniffing, the error is of reading it.
+func (s *Server) guessMimeType(fp string, content io.ReadSeeker) (string, error) {
+	if ext := strings.ToLower(filepath.Ext(fp)); ext != "" {
+		if mimet := s.mimeTypes[ext]; mimet != "" {
+			return mimet, nil
+		}
+		if mimet := builtinMimeTypes[ext]; mimet != "" {
+			return mimet, nil
+		}
+		if mimet := mime.TypeByExtension(ext); mimet != "" {
+			return mimet, nil
+		}
+	}
+
+	// e.g. files without extension, which are common on Unix
+	if content != nil {
+		return sniffMimeType(content)
+	}
+
+	return defaultMimeType, nil
+}
+
+// MIME-type of files of unknown type, i.e. 'binary data'.
+const defaultMimeType = "application/octet-stream"
+
+// Detect MIME-type from the first 512 bytes of rs, for files the
+// extension says nothing about. rs is rewound afterwards, so that
+// the bytes read are still served.
+func sniffMimeType(rs io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(rs, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err = rs.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// Format size in bytes as a human-readable string using
+// binary units, e.g. "4.2 KiB".
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	// the next unit once the value would round to 1024.0, e.g.
+	// "1.0 MiB" rather than "1024.0 KiB" for 1048575
+	v, exp := float64(n)/1024, 0
+	for v >= 1023.95 && exp < len(units)-1 {
+		v /= 1024
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", v, units[exp])
+}
+
+// Content-Disposition header for downloading a file with
+// this name. Quotes and non-ASCII characters are escaped.
+func attachment(name string) string {
+	if d := mime.FormatMediaType("attachment", map[string]string{"filename": name}); d != "" {
+		return d
+	}
+	// name is not valid UTF-8
+	return "attachment"
+}
+
+// Generate an ETag from size and modification time of the
+// file, which is cheap and doesn't require reading it. It is
+// strong, since files are sent byte for byte, so that If-Range
+// can match it. The Compress middleware makes it weak for gzipped
+// responses.
+func fileETag(inf os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, inf.Size(), inf.ModTime().UnixNano())
+}
+
+// Main entry point of the HTTP handling pipeline. Logs the
+// request and removes the URL path prefix, if any.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	infof("%s: %s - %s", r.Method, r.RemoteAddr, r.RequestURI)
+
+	// the rest of the handling only sees the path below the prefix
+	if s.prefix != "" {
+		rest, ok := strings.CutPrefix(r.URL.Path, s.prefix)
+		if !ok || rest != "" && rest[0] != '/' {
+			serveFailure(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+
+		if rest == "" {
+			s.redirectDir(w, r, rest)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), prefixKey{}, s.prefix))
+		r.URL = &url.URL{Path: "/" + strings.TrimPrefix(rest, "/"), RawQuery: r.URL.RawQuery}
+	}
+
+	s.serve(w, r)
+}
+
+// Redirect request for the directory at path (below the prefix)
+// to the path with trailing slash, keeping the query.
+func (s *Server) redirectDir(w http.ResponseWriter, r *http.Request, path string) {
+	u := url.URL{Path: s.prefix + path + "/", RawQuery: r.URL.RawQuery}
+
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// unlike 301, clients must not change the method
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u.String(), code)
+}
+
+// General logic: client requests a path (file or directory).
+// We check if request is admissable and pass the request on
+// to the other functions.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	var (
+		sp   *safePath
+		inf  os.FileInfo
+		code int
+	)
+
+	if s.dav != nil && (r.URL.Path == davPrefix || strings.HasPrefix(r.URL.Path, davPrefix+"/")) {
+		s.serveDAV(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		if s.upload {
+			break
+		}
+		fallthrough
+	default:
+		w.Header().Set("Allow", s.allowedMethods())
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		serveFailure(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if r.URL.Path == "/~health" {
+		s.serveHealth(w, r)
+		return
+	}
+
+	if r.URL.Path == "/~version" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, Version+"\n")
+		return
+	}
+
+	if r.URL.Path == "/~stats" {
+		s.serveStats(w, r)
+		return
+	}
+
+	if r.URL.Path == "/~search" {
+		s.serveSearch(w, r)
+		return
+	}
+
+	if r.URL.Path == eventsPrefix {
+		s.serveEvents(w, r)
+		return
+	}
+
+	if r.URL.Path == manifestPrefix {
+		s.serveManifest(w, r)
+		return
+	}
+
+	if r.URL.Path == signedPrefix {
+		s.serveSigned(w, r)
+		return
+	}
+
+	if r.URL.Path == thumbPrefix && s.thumbnail {
+		s.serveThumb(w, r)
+		return
+	}
+
+	if r.URL.Path == "/~favicon.ico" {
+		serveIcon(w, r)
+		return
+	}
+
+	if sp = s.parseSafePath(r.URL.Path); sp == nil {
+		serveFailure(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+	sp.compress = r.URL.Query().Get("download") == "zip" || r.URL.Query().Get("zip") == "1"
+	if (s.once != nil || s.noListing || s.signedOnly) && sp.compress {
+		// the file would be served without being noticed, or
+		// names of files would be revealed
+		serveFailure(w, r, http.StatusForbidden, "archives are not available")
+		return
+	}
+
+	if sp.root == "" {
+		if sp.compress {
+			serveFailure(w, r, http.StatusBadRequest, "invalid path")
+			return
+		}
+		s.serveDir(w, r, sp)
+		return
+	}
+
+	// the file doesn't exist yet, its directory is checked instead
+	if s.upload && r.Method == http.MethodPut {
+		s.servePut(w, r, sp)
+		return
+	}
+
+	start := time.Now()
+	inf, code = s.statShared(sp)
+	if code == http.StatusNotFound && s.foldCase {
+		if m := s.matchCase(sp); m != nil {
+			sp = m
+			inf, code = s.statShared(sp)
+		}
+	}
+	if code != http.StatusOK {
+		serveFailure(w, r, code, http.StatusText(code))
+		return
+	}
+	addTiming(w, "stat", start)
+
+	if !s.authorized(w, r, sp, inf.IsDir()) {
+		return
+	}
+
+	// HEAD is handled by serveFile (via http.ServeContent) and serveDir,
+	// zip archives are generated on the fly, so we only send headers
+	if inf.IsDir() && sp.compress && r.Method == http.MethodHead {
+		w.Header().Set("Content-Disposition", attachment(filepath.Base(sp.abs)+".zip"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Accept-Ranges", "none")
+		return
+	}
+
+	if inf.IsDir() && sp.compress {
+		if !s.startTransfer() {
+			serveBusy(w, r)
+			return
+		}
+		defer s.endTransfer()
+
+		if err := s.serveCompressed(w, r, sp); err != nil {
+			log.Printf("compress [%s]: %s", sp.abs, err.Error())
+			serveFailure(w, r, http.StatusBadRequest, "invalid path")
+		}
+		return
+	}
+
+	if inf.IsDir() && s.upload && r.Method == http.MethodPost {
+		s.serveUpload(w, r, sp)
+	} else if inf.IsDir() && !strings.HasSuffix(r.URL.Path, "/") {
+		// relative links (e.g. of index files) resolve against the directory
+		s.redirectDir(w, r, r.URL.Path)
+	} else if inf.IsDir() {
+		if idx := s.indexOf(sp); idx != nil && r.URL.Query().Get("list") != "1" {
+			s.serveShared(w, r, idx)
+		} else {
+			s.serveDir(w, r, sp)
+		}
+	} else {
+		s.serveShared(w, r, sp)
+	}
+}
+
+// Serve file p, unless files are only served via signed links,
+// and only to the first complete download in one-shot mode. Index
+// files of directories are served this way as well, so that
+// neither can be bypassed by requesting the directory.
+func (s *Server) serveShared(w http.ResponseWriter, r *http.Request, p *safePath) {
+	if s.signedOnly {
+		serveFailure(w, r, http.StatusForbidden, "only signed links are served")
+	} else if s.once != nil {
+		s.serveOnce(w, r, p)
+	} else {
+		s.serveFile(w, r, p)
+	}
+}
+
+// Methods of requests the server handles (outside of WebDAV).
+func (s *Server) allowedMethods() string {
+	if s.upload {
+		return "GET, HEAD, POST, PUT, OPTIONS"
+	}
+	return "GET, HEAD, OPTIONS"
+}
+
+// Stat the target of sp and check if it is shared. Returns
+// the status code to fail the request with if it isn't, or
+// http.StatusOK otherwise.
+func (s *Server) statShared(sp *safePath) (os.FileInfo, int) {
+	var (
+		err error
+		inf os.FileInfo
+	)
+
+	// pretend hidden files don't exist
+	if sp.hidden && !s.hidden {
+		return nil, http.StatusNotFound
+	}
+
+	if sp.local && !s.symlinkSafe(sp.abs, sp.root) {
+		return nil, http.StatusForbidden
+	}
+
+	if inf, err = fs.Stat(sp.fsys, sp.name); err != nil {
+		log.Printf("     stat target: %v", err)
+		return nil, http.StatusNotFound
+	}
+
+	if sp.ignore.ignored(sp.name, inf.IsDir()) {
+		debugf("     ignored by %s", ignoreFile)
+		return nil, http.StatusNotFound
+	}
+
+	// credentials are never shared, and case may not matter to
+	// the file system
+	if strings.EqualFold(path.Base(sp.name), authFile) {
+		return nil, http.StatusNotFound
+	}
+
+	if inf.IsDir() {
+		if sp.abs == sp.root || (s.recursive && s.depthShared(sp.abs, sp.root)) {
+			return inf, http.StatusOK
+		}
+	} else if !inf.Mode().IsRegular() {
+		// reading devices, fifos, etc. might block forever
+		log.Printf("     not a regular file [%s]", inf.Mode())
+		return nil, http.StatusForbidden
+	} else if !s.extShared(sp.abs) {
+		return nil, http.StatusNotFound
+	} else if s.maxSize > 0 && inf.Size() > s.maxSize {
+		log.Printf("     file too large (%d bytes)", inf.Size())
+		return nil, http.StatusRequestEntityTooLarge
+	} else {
+		if filepath.Dir(sp.abs) == sp.root || (s.recursive && s.depthShared(filepath.Dir(sp.abs), sp.root)) {
+			return inf, http.StatusOK
+		}
+	}
+
+	if s.recursive {
+		return nil, http.StatusForbidden
+	}
+
+	return nil, http.StatusUnauthorized
+}
+
+// Find the entry of the directory of sp whose name only differs
+// in case from that of sp (e.g. 'README.md' for 'Readme.md').
+// Returns nil if there is none, or several which would make the
+// choice arbitrary. Only the last component is matched.
+func (s *Server) matchCase(sp *safePath) *safePath {
+	var match *safePath
+
+	if sp.name == "." {
+		return nil
+	}
+
+	dir := s.rootOf(sp).child(path.Dir(sp.name))
+	base := path.Base(sp.name)
+
+	entries, err := fs.ReadDir(dir.fsys, dir.name)
+	if err != nil {
+		return nil
+	}
+
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), base) {
+			if match != nil {
+				return nil
+			}
+			match = dir.child(e.Name())
+		}
+	}
+
+	if match != nil {
+		debugf("     matched [%s] ignoring case", match.abs)
+		match.compress = sp.compress
+	}
+	return match
+}
+
+// Find the index file in directory p, returns nil if there
+// is none or it's not shared.
+func (s *Server) indexOf(p *safePath) *safePath {
+	if s.indexFile == "" {
+		return nil
+	}
+
+	idx := p.child(s.indexFile)
+
+	// most directories have none, don't log it as a failure
+	if _, err := fs.Stat(idx.fsys, idx.name); err != nil {
+		return nil
+	}
+
+	if inf, code := s.statShared(idx); code != http.StatusOK || inf.IsDir() {
+		return nil
+	}
+	return idx
+}
+
+// Write HTTP-status-code indicating failure and the error
+// message, as a small HTML page if the client is a browser
+// and as plain text otherwise.
+func serveFailure(w http.ResponseWriter, r *http.Request, code int, message string) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		w.Write([]byte(message))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+
+	err := errorPage.Execute(w, struct {
+		Code    int
+		Status  string
+		Message string
+		Prefix  string
+	}{code, http.StatusText(code), message, linkPrefix(r)})
+	if err != nil {
+		log.Printf("     execute error page: %v", err)
+	}
 }
 
-// Check if the requested path is admissible. If so, return
-// a safePath instance. Path is admissible if it is
-// valid and a subpath of root.
-// TODO handle symlinks and non-regular files.
-func parseSafePath(raw string) *safePath {
+// Error page for browsers, styled like the listing template.
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<title>sharedir: {{ .Code }} {{ .Status }}</title>
+		<link rel="icon" type="image/x-icon" href="{{ .Prefix }}/~favicon.ico">
+		<style type="text/css">
+			html * { color: #323232 !important; }
+		</style>
+	</head>
+	<body>
+		<h2>{{ .Code }} {{ .Status }}</h2>
+		{{- if ne .Message .Status }}
+		<p>{{ .Message }}</p>
+		{{- end }}
+		<small><a href="{{ .Prefix }}/">back to the shared directories</a></small>
+	</body>
+</html>
+`))
+
+// Stream content of the file to the client, without loading
+// it into memory. Range requests (resumable downloads) and
+// conditional requests (Last-Modified, ETag) are
+// handled by http.ServeContent.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, p *safePath) {
+
 	var (
-		sp  *safePath
 		err error
+		f   fs.File
+		inf os.FileInfo
 	)
 
-	sp = new(safePath)
+	if !s.startTransfer() {
+		serveBusy(w, r)
+		return
+	}
+	defer s.endTransfer()
 
-	if strings.HasSuffix(raw, compressQuery) {
-		raw = strings.TrimSuffix(raw, compressQuery)
-		sp.compress = true
+	start := time.Now()
+	if f, err = p.fsys.Open(p.name); err != nil {
+		log.Printf("     open file [%s]: %v", p.abs, err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return
 	}
+	defer f.Close()
 
-	raw = strings.TrimPrefix(raw, "/")
-	raw = html.UnescapeString(raw)
-	raw = strings.ReplaceAll(raw, "%20", " ")
-	raw = strings.ReplaceAll(raw, "%28", "(")
-	raw = strings.ReplaceAll(raw, "%29", ")")
+	// files of os.DirFS and embed.FS can seek
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		log.Printf("     file [%s] doesn't support seeking", p.abs)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return
+	}
 
-	sp.abs = filepath.Join(root, raw)
+	if inf, err = f.Stat(); err != nil {
+		log.Printf("     stat file [%s]: %v", p.abs, err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return
+	}
+	addTiming(w, "open", start)
 
-	if sp.abs, err = filepath.Abs(sp.abs); err != nil {
-		log.Printf("     absolute path: %v", err)
-		return nil
+	if renderable(r, inf) {
+		if s.markdown && strings.EqualFold(filepath.Ext(inf.Name()), ".md") {
+			serveMarkdown(w, r, rs, inf)
+			return
+		}
+		// binary files are served as they are
+		if s.preview && s.previewable(inf.Name()) && servePreview(w, r, rs, inf) {
+			return
+		}
 	}
 
-	if !strings.HasPrefix(sp.abs, root) {
-		log.Print("     not in root")
-		return nil
+	// set explicitly, otherwise ServeContent would guess by extension
+	// again, ignoring types set with '-mime'
+	start = time.Now()
+	mimet, err := s.guessMimeType(p.rel, rs)
+	if err != nil {
+		log.Printf("     read file [%s]: %v", p.abs, err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
+		return
+	}
+	addTiming(w, "type", start)
+	w.Header().Set("Content-Type", mimet)
+	// ServeContent checks If-None-Match against this header
+	// and If-Range: a range of a file that changed since (stale ETag or
+	// Last-Modified) is not served, but the whole file with 200
+	w.Header().Set("ETag", fileETag(inf))
+
+	// force download instead of displaying in the browser
+	if r.URL.Query().Get("download") == "1" {
+		w.Header().Set("Content-Disposition", attachment(inf.Name()))
 	}
 
-	if sp.abs != root {
-		sp.rel = strings.TrimPrefix(sp.abs, root)
-		sp.rel = strings.TrimPrefix(sp.rel, "/")
+	var content io.ReadSeeker = rs
+	if s.bwlimit > 0 {
+		content = throttledReadSeeker{newThrottledReader(r.Context(), rs, s.bwlimit), rs}
 	}
 
-	return sp
+	// Content-Length is derived by ServeContent from the file size
+	// (by seeking f), so we don't stat the file a second time. It
+	// also sends 'Accept-Ranges: bytes' for GET and HEAD.
+	sw := &statusWriter{ResponseWriter: w}
+
+	// stop the copy as soon as the request is canceled (e.g. the
+	// client disconnected), instead of reading the file on until a
+	// write fails. Unlike a reader checking the context, a write
+	// deadline also interrupts sendfile
+	rc := http.NewResponseController(sw)
+	stop := context.AfterFunc(r.Context(), func() {
+		debugf("     request canceled, stopping transfer")
+		rc.SetWriteDeadline(time.Now())
+	})
+	http.ServeContent(sw, r, inf.Name(), inf.ModTime(), content)
+	// the connection might be reused once we return
+	stop()
+
+	// not for 304 etc., nor for downloads that were aborted
+	if logTransfer(r, sw, inf.Size()) && isDownload(r) {
+		s.stats.add("/" + p.rel)
+	}
 }
 
-// Guess MIME-type of file based on file extension.
-// By default assume 'binary data'.
-func guessMimeType(fp string) string {
-	var mimet, ext string
+// Log whether the body of a file of size bytes was sent
+// completely, or how much of it before the transfer was aborted
+// (e.g. because the client disconnected). Returns true in the
+// first case.
+func logTransfer(r *http.Request, sw *statusWriter, size int64) bool {
+	// no body for HEAD, 304, 416, etc.
+	if r.Method == http.MethodHead || (sw.status != http.StatusOK && sw.status != http.StatusPartialContent) {
+		debugf("     served headers (%d)", sw.status)
+		return false
+	}
 
-	if ext = filepath.Ext(fp); ext != "" {
-		mimet = mime.TypeByExtension(ext)
+	// of the range for 206
+	want, err := strconv.ParseInt(sw.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		want = size
+	}
 
-		if mimet != "" {
-			return mimet
+	if sw.size < want {
+		cause := "write failed"
+		if err := r.Context().Err(); err != nil {
+			cause = "client gone"
 		}
+		infof("     transfer aborted after %d of %d bytes (%s)", sw.size, want, cause)
+		return false
+	}
+
+	if sw.status == http.StatusPartialContent {
+		infof("     served %d bytes of file of %d bytes", sw.size, size)
+	} else {
+		infof("     served file of %d bytes", sw.size)
 	}
+	return true
+}
 
-	return "application/octet-stream"
+// Add a phase that took since start to the Server-Timing header,
+// e.g. 'stat;dur=0.3', for developers to see where time is spent.
+// Has to be called before the response is written.
+func addTiming(w http.ResponseWriter, name string, start time.Time) {
+	v := fmt.Sprintf("%s;dur=%.2f", name, float64(time.Since(start).Microseconds())/1000)
+	if prev := w.Header().Get("Server-Timing"); prev != "" {
+		v = prev + ", " + v
+	}
+	w.Header().Set("Server-Timing", v)
 }
 
-// Main entry point of the HTTP handling pipeline.
-// General logic: client requests a path (file or directory).
-// We check if request is admissable and pass the request on
-// to the other functions.
-func serve(w http.ResponseWriter, r *http.Request) {
+// Take a slot of the transfer limit, returns false if all are
+// taken. Slots must be given back with endTransfer.
+func (s *Server) startTransfer() bool {
+	if s.transfers == nil {
+		return true
+	}
+
+	select {
+	case s.transfers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) endTransfer() {
+	if s.transfers != nil {
+		<-s.transfers
+	}
+}
+
+// Fail request because all transfer slots are taken.
+func serveBusy(w http.ResponseWriter, r *http.Request) {
+	infof("     too many transfers")
+	w.Header().Set("Retry-After", "10")
+	serveFailure(w, r, http.StatusServiceUnavailable, "too many transfers, try again later")
+}
+
+// Check if file may be rendered as HTML page (Markdown or
+// preview): browsers get the page, unless they ask for the
+// source with '?raw=1' or download the file.
+func renderable(r *http.Request, inf os.FileInfo) bool {
+	q := r.URL.Query()
+
+	return inf.Size() <= renderMax &&
+		strings.Contains(r.Header.Get("Accept"), "text/html") &&
+		q.Get("raw") != "1" && q.Get("download") != "1"
+}
+
+// Report that the server is up, e.g. for load balancers. Doesn't
+// access the file system, so it stays cheap.
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	var roots []string
+
+	for _, m := range s.mounts {
+		roots = append(roots, m.root)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(struct {
+		Status    string   `json:"status"`
+		Uptime    float64  `json:"uptime"` // seconds
+		Version   string   `json:"version"`
+		Roots     []string `json:"roots"`
+		Recursive bool     `json:"recursive"`
+	}{"ok", time.Since(s.started).Seconds(), Version, roots, s.recursive})
+	if err != nil {
+		log.Printf("     encode json: %v", err)
+	}
+}
+
+func serveIcon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/x-icon")
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	http.ServeContent(w, r, "sharedir.ico", time.Time{}, bytes.NewReader(icon))
+}
+
+func (s *Server) serveDir(w http.ResponseWriter, r *http.Request, p *safePath) {
 	var (
-		sp  *safePath
 		err error
-		inf os.FileInfo
+		key string
+		mod time.Time
 	)
 
-	log.Printf("%s: %s - %s", r.Method, r.RemoteAddr, r.RequestURI)
+	start := time.Now()
 
-	if r.RequestURI == "/~favicon.ico" {
-		serveIcon(w)
+	if s.noListing {
+		serveFailure(w, r, http.StatusForbidden, "listing is disabled")
 		return
 	}
 
-	if sp = parseSafePath(r.RequestURI); sp == nil {
-		serveFailure(w, http.StatusBadRequest, "invalid path")
-		return
+	// signed links that expire can't be kept
+	cacheable := s.signer == nil || s.signer.ttl == 0
+
+	// the listing depends on the query and, via the format, on the
+	// Accept header. Modification time is read before the entries,
+	// a change in between only makes the next request render again.
+	if s.listings != nil && p.root != "" && cacheable {
+		if inf, err := fs.Stat(p.fsys, p.name); err == nil {
+			key = p.abs + "\x00" + listingFormat(r) + "\x00" + r.URL.RawQuery
+			mod = inf.ModTime()
+
+			if c, ok := s.listings.get(key); ok && c.modified.Equal(mod) {
+				debugf("     serving cached listing")
+				addTiming(w, "cache", start)
+				w.Header().Set("Content-Type", c.contentType)
+				if r.Method != http.MethodHead {
+					w.Write(c.body)
+				}
+				return
+			}
+		}
 	}
 
-	if inf, err = os.Stat(sp.abs); err != nil {
-		log.Printf("     stat target: %v", err)
-		serveFailure(w, http.StatusNotFound, "invalid path")
+	data := listingData{
+		DirName:  "/" + p.rel,
+		Compress: p.root != "",
+		Upload:   s.upload && p.root != "",
+		rel:      p.rel,
+		live:     s.live && p.root != "",
+	}
+
+	if p.root == "" {
+		data.Content, err = s.readMounts()
+	} else {
+		data.Content, err = fs.ReadDir(p.fsys, p.name)
+		data.Content = s.filterEntries(p, data.Content)
+	}
+
+	if err != nil {
+		log.Printf("     read dir: %v", err)
+		serveFailure(w, r, http.StatusInternalServerError, "server error")
 		return
 	}
 
-	if inf.IsDir() && sp.compress {
-		if err := serveCompressed(w, sp); err != nil {
-			log.Printf("compress [%s]: %s", sp.abs, err.Error())
-			serveFailure(w, http.StatusBadRequest, "invalid path")
-		}
+	// e.g. to find entries of large directories, without JavaScript
+	if f := r.URL.Query().Get("filter"); f != "" {
+		data.Content = filterNames(data.Content, f)
+		data.Filter = f
+		data.query = url.Values{"filter": {f}}.Encode()
+	}
+
+	addTiming(w, "read", start)
+
+	// responses to HEAD have no body to render
+	if r.Method == http.MethodHead {
+		s.serveListing(w, r, data)
 		return
 	}
 
-	if inf.IsDir() {
-		if recursive || sp.abs == root {
-			serveDir(w, sp)
-			return
-		}
-	} else {
-		if recursive || filepath.Dir(sp.abs) == root {
-			serveFile(w, sp)
-			return
-		}
+	// rendered into memory, to be kept and to report how long it took
+	start = time.Now()
+	b := &bufferWriter{header: make(http.Header)}
+	s.serveListing(b, r, data)
+	addTiming(w, "render", start)
+
+	if key != "" {
+		s.listings.put(key, cachedListing{mod, b.header.Get("Content-Type"), b.Bytes()})
 	}
 
-	serveFailure(w, http.StatusUnauthorized, "unauthorized")
+	w.Header().Set("Content-Type", b.header.Get("Content-Type"))
+	if _, err = w.Write(b.Bytes()); err != nil {
+		log.Printf("     write response: %v", err)
+	}
 }
 
-// Write HTTP-status-code indicating failure and the plain-text
-// error message.
-func serveFailure(w http.ResponseWriter, code int, message string) {
-	w.WriteHeader(code)
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(message))
+// Keep entries whose names contain sub, ignoring case.
+func filterNames(entries []os.DirEntry, sub string) []os.DirEntry {
+	var matches []os.DirEntry
+
+	sub = strings.ToLower(sub)
+	for _, e := range entries {
+		if strings.Contains(strings.ToLower(e.Name()), sub) {
+			matches = append(matches, e)
+		}
+	}
+	return matches
 }
 
-func serveFile(w http.ResponseWriter, p *safePath) {
+// Sort entries of the listing and write it as HTML or JSON.
+func (s *Server) serveListing(w http.ResponseWriter, r *http.Request, data listingData) {
+	var err error
 
-	var (
-		err  error
-		size int
-		data []byte
-	)
+	data.Sort, data.Desc = sortParams(r)
+	// thumbnails are refused where files are not served directly
+	data.thumbs = s.thumbnail && s.once == nil && !s.signedOnly
+	data.signer = s.signer
+	data.Prefix = s.prefix
+	sortEntries(data.Content, data.Sort, data.Desc)
 
-	if data, err = os.ReadFile(p.abs); err != nil {
-		log.Printf("     read file [%s]: %v", p.abs, err)
-		serveFailure(w, http.StatusInternalServerError, "server error")
+	format := listingFormat(r)
+
+	// scripts get all entries, unless they ask for a page
+	if q := r.URL.Query(); format == "html" || q.Has("page") || q.Has("per") {
+		paginate(r, &data)
+	}
+
+	switch format {
+	case "json":
+		serveDirJSON(w, r, data.Content)
+		return
+	case "text":
+		serveDirText(w, r, data.Content)
 		return
 	}
 
-	if size, err = w.Write(data); err != nil {
-		log.Printf("     write response: %v", err)
-		serveFailure(w, http.StatusInternalServerError, "server error")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if r.Method == http.MethodHead {
 		return
 	}
 
-	w.Header().Set("Content-Type", guessMimeType(p.rel))
-	log.Printf("     served %d bytes", size)
+	// response is partially written at this point, so we can only log
+	if err = s.listing.Execute(w, data); err != nil {
+		log.Printf("     execute template: %v", err)
+	}
+}
+
+// Read sort key and order of the listing from the "sort" and
+// "order" query parameters. Invalid values fall back to sorting
+// by name in ascending order.
+func sortParams(r *http.Request) (string, bool) {
+	var by, order string
+
+	q := r.URL.Query()
+	if by = q.Get("sort"); by != "size" && by != "modified" {
+		by = "name"
+	}
+
+	order = q.Get("order")
+	return by, order == "desc"
+}
+
+// Data passed to the listing template. Exported fields and
+// methods are available to custom templates (see README).
+type listingData struct {
+	DirName  string
+	Content  []os.DirEntry
+	Compress bool   // directory can be downloaded as zip
+	Upload   bool   // files can be uploaded into directory
+	Search   bool   // listing of search results, not of a directory
+	Filter   string // entries are filtered by, empty if not filtered
+	Sort     string // key the entries are sorted by
+	Desc     bool   // sorted in descending order
+	Page     int    // current page, starting at 1
+	Pages    int    // number of pages
+	Prefix   string // URL path prefix of links, without trailing slash
+	rel      string // path of directory relative to root
+	thumbs   bool   // link thumbnails of images
+	signer   *urlSigner
+	live     bool   // reload on changes of the directory
+	query    string // other query parameters of the listing, encoded
+	per      int    // entries per page
+}
+
+// Link to entry n of the directory.
+func (d listingData) Href(n string) string {
+	if d.rel == "" {
+		return escapePath(n)
+	}
+	return escapePath(d.rel + "/" + n)
+}
+
+// Link to the event stream of the directory, with prefix. Empty
+// unless listings reload on changes ('-live').
+func (d listingData) Events() string {
+	if !d.live {
+		return ""
+	}
+	return d.Prefix + eventsPrefix + "?" + url.Values{"path": {d.rel}}.Encode()
+}
+
+// Signed link to entry n of the directory, with prefix. Empty
+// if no secret is given.
+func (d listingData) Signed(n string) string {
+	if d.signer == nil {
+		return ""
+	}
+	return d.Prefix + d.signer.link("/"+strings.TrimPrefix(d.rel+"/"+n, "/"))
+}
+
+// Link to the thumbnail of entry n, empty if it's not an image
+// or thumbnails are disabled.
+func (d listingData) Thumb(n string) string {
+	if !d.thumbs || !thumbable(n) {
+		return ""
+	}
+	return d.Prefix + thumbPrefix + "?" + url.Values{"path": {strings.TrimPrefix(d.rel+"/"+n, "/")}}.Encode()
 }
 
-func serveIcon(w http.ResponseWriter) {
-	var p *safePath
+// Link to the parent directory, with prefix and leading slash.
+// Empty for the root, which has no parent.
+func (d listingData) Parent() string {
+	if d.rel == "" {
+		return ""
+	}
 
-	p = new(safePath)
-	p.abs = filepath.Join(home, "sharedir.ico")
-	serveFile(w, p)
+	i := strings.LastIndex(d.rel, "/")
+	if i < 0 {
+		return d.Prefix + "/"
+	}
+	return d.Prefix + "/" + escapePath(d.rel[:i]) + "/"
 }
 
-func serveDir(w http.ResponseWriter, p *safePath) {
+// Link to an ancestor of a directory.
+type breadcrumb struct {
+	Name string
+	Href string // escaped path, without leading slash, with trailing slash
+}
 
+// Links to root and each ancestor of the directory down to
+// the directory itself.
+func (d listingData) Breadcrumbs() []breadcrumb {
 	var (
-		err error
-		tmp *template.Template
+		crumbs []breadcrumb
+		path   string
 	)
 
-	data := struct {
-		DirName string
-		Content []os.DirEntry
-	}{DirName: "/" + p.rel}
-
-	if data.Content, err = os.ReadDir(p.abs); err != nil {
-		log.Fatalf("read dir: %v", err)
+	crumbs = append(crumbs, breadcrumb{Name: "/"})
+	if d.rel == "" {
+		return crumbs
 	}
 
-	tmp, err = template.New(templateFp).Funcs(
-		template.FuncMap{
-			"ttos": func(t time.Time) string {
-				return t.Format("2006-01-02 15:04:05")
-			},
-			"href": func(n string) string {
-				if p.rel == "" {
-					return n
-				}
-				return filepath.Join(p.rel, n)
-			},
-			"zref": func(n string) string {
-				return n + compressQuery
-			},
-		}).ParseFiles(filepath.Join(home, templateFp))
+	for _, n := range strings.Split(d.rel, "/") {
+		path = strings.TrimPrefix(path+"/"+n, "/")
+		crumbs = append(crumbs, breadcrumb{Name: n, Href: escapePath(path) + "/"})
+	}
+	return crumbs
+}
 
-	if err != nil {
-		log.Fatalf("parse template: %v", err)
+// Percent-encode each segment of the slash-separated path,
+// so that it can be used in a link.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
 	}
+	return strings.Join(segments, "/")
+}
+
+// Link to the listing sorted by key. Clicking the current
+// column again toggles the order.
+func (d listingData) SortRef(by string) string {
+	return d.ref(by, by == d.Sort && !d.Desc, 1)
+}
 
-	if err = tmp.Execute(w, data); err != nil {
-		log.Fatalf("execute template: %v", err)
+// Link to page n of the listing.
+func (d listingData) PageRef(n int) string {
+	return d.ref(d.Sort, d.Desc, n)
+}
+
+// Link to the previous page, empty on the first one.
+func (d listingData) PrevRef() string {
+	if d.Page <= 1 {
+		return ""
 	}
+	return d.PageRef(d.Page - 1)
+}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+// Link to the next page, empty on the last one.
+func (d listingData) NextRef() string {
+	if d.Page >= d.Pages {
+		return ""
+	}
+	return d.PageRef(d.Page + 1)
 }
 
-func serveCompressed(w http.ResponseWriter, p *safePath) error {
+// Link to the listing sorted and paginated as given.
+func (d listingData) ref(by string, desc bool, page int) string {
+	q, _ := url.ParseQuery(d.query)
 
-	// read files in target directory
-	directoryContent, err := os.ReadDir(p.abs)
-	if err != nil {
-		return err
+	q.Set("sort", by)
+	if desc {
+		q.Set("order", "desc")
+	} else {
+		q.Set("order", "asc")
 	}
 
-	// Create a new zip writer
-	zipWriter := zip.NewWriter(w)
-	defer zipWriter.Close()
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
+	}
+	if d.per != pageSize && d.per > 0 {
+		q.Set("per", strconv.Itoa(d.per))
+	}
 
-	var count int
+	return "?" + q.Encode()
+}
 
-	// Open target files and create compressed files
-	for _, dirEntry := range directoryContent {
+// Reduce content of the listing to the page given by the
+// "page" and "per" query parameters. Invalid values fall back
+// to the first page and the default page size.
+func paginate(r *http.Request, data *listingData) {
+	var err error
 
-		if dirEntry.IsDir() {
-			continue
-		}
+	q := r.URL.Query()
+	if data.per, err = strconv.Atoi(q.Get("per")); err != nil || data.per < 1 {
+		data.per = pageSize
+	}
+
+	data.Pages = max(1, (len(data.Content)+data.per-1)/data.per)
+	if data.Page, err = strconv.Atoi(q.Get("page")); err != nil || data.Page < 1 {
+		data.Page = 1
+	}
+	data.Page = min(data.Page, data.Pages)
 
-		originalFile, err := os.Open(filepath.Join(p.abs, dirEntry.Name()))
+	start := (data.Page - 1) * data.per
+	data.Content = data.Content[start:min(start+data.per, len(data.Content))]
+}
+
+// Functions available in the listing template.
+var templateFuncs = template.FuncMap{
+	"ttos": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"zref": func(n string) string {
+		return escapePath(n) + compressQuery
+	},
+	"size": func(e os.DirEntry) string {
+		if e.IsDir() {
+			return "-"
+		}
+		inf, err := e.Info()
 		if err != nil {
-			return err
+			return "-"
 		}
-		defer originalFile.Close()
+		return formatSize(inf.Size())
+	},
+}
 
-		compressedFile, err := zipWriter.Create(dirEntry.Name())
-		if err != nil {
-			return err
+// Parse the listing template from file fp, or the embedded
+// template if fp is empty.
+func parseTemplate(fp string) (*template.Template, error) {
+	if fp != "" {
+		return template.New(filepath.Base(fp)).Funcs(templateFuncs).ParseFiles(fp)
+	}
+	return template.New(templateFp).Funcs(templateFuncs).ParseFS(templateFS, templateFp)
+}
+
+// Sort directory entries with directories first, each group
+// sorted by the key ("name", "size" or "modified"). Names are
+// compared case-insensitively and break ties of other keys.
+func sortEntries(entries []os.DirEntry, by string, desc bool) {
+	var (
+		sizes = make(map[string]int64, len(entries))
+		times = make(map[string]time.Time, len(entries))
+	)
+
+	// entries without info (removed in the meantime) get zero values
+	if by != "name" {
+		for _, e := range entries {
+			if inf, err := e.Info(); err == nil {
+				sizes[e.Name()] = inf.Size()
+				times[e.Name()] = inf.ModTime()
+			}
 		}
+	}
 
-		_, err = io.Copy(compressedFile, originalFile)
-		if err != nil {
-			return err
+	// compare entries by the key only, <0 if a comes first
+	cmp := func(a, b os.DirEntry) int {
+		switch by {
+		case "size":
+			if sizes[a.Name()] != sizes[b.Name()] {
+				if sizes[a.Name()] < sizes[b.Name()] {
+					return -1
+				}
+				return 1
+			}
+		case "modified":
+			if c := times[a.Name()].Compare(times[b.Name()]); c != 0 {
+				return c
+			}
 		}
-		count += 1
+		return strings.Compare(strings.ToLower(a.Name()), strings.ToLower(b.Name()))
 	}
 
-	var zipFilename string
-	if p.rel == "" {
-		zipFilename = "sharedir_rootdirectory.zip"
-	} else {
-		zipFilename = "sharedir_" + p.rel + ".zip"
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		if desc {
+			return cmp(entries[i], entries[j]) > 0
+		}
+		return cmp(entries[i], entries[j]) < 0
+	})
+}
+
+// Format of the listing the client asked for, either with the
+// "format" query parameter or with the Accept header: "json",
+// "text" (for clients that don't accept HTML, like curl) or
+// "html".
+func listingFormat(r *http.Request) string {
+	switch f := r.URL.Query().Get("format"); f {
+	case "json", "text", "html":
+		return f
 	}
-	w.Header().Set("Content-Disposition", `attachment; filename="`+zipFilename+`"`)
-	w.Header().Set("Content-Type", "application/zip")
-	log.Printf("     served %d compressed files in directory %s (%s)", count, p.rel, zipFilename)
 
-	return nil
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/json"):
+		return "json"
+	case !strings.Contains(accept, "text/html"):
+		return "text"
+	}
+	return "html"
 }
 
-const usage = `Quickly and safely share content of a directory over HTTP.
+// Write directory listing as plain text, one entry per line,
+// directories with a trailing slash.
+func serveDirText(w http.ResponseWriter, r *http.Request, content []os.DirEntry) {
+	var b strings.Builder
 
-Usage: sharedir [-r] [-a ADDR] [directory]
+	for _, e := range content {
+		b.WriteString(e.Name())
+		if e.IsDir() {
+			b.WriteString("/")
+		}
+		b.WriteString("\n")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-Options and arguments:
-    -r          Recursive mode (also share subdirectories)
-    -a ADDR     Start HTTP server on this address (default: ':2022')
-    directory   Directory to share (default: current directory)
-	
-Report bugs: https://github.com/vgratian/sharedir
-`
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		log.Printf("     write response: %v", err)
+	}
+}
 
-func main() {
+// Entry of a directory listing in JSON format.
+type jsonEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	IsDir   bool      `json:"isDir"`
+}
 
+// Write directory listing as a JSON array.
+func serveDirJSON(w http.ResponseWriter, r *http.Request, content []os.DirEntry) {
 	var (
-		mux  *http.ServeMux
-		srv  http.Server
-		err  error
-		addr string
+		err     error
+		inf     os.FileInfo
+		entries []jsonEntry
 	)
 
-	addr = ":2022"
+	entries = make([]jsonEntry, 0, len(content))
+	for _, e := range content {
+		// entry might have been removed in the meantime
+		if inf, err = e.Info(); err != nil {
+			continue
+		}
+		entries = append(entries, jsonEntry{e.Name(), inf.Size(), inf.ModTime(), e.IsDir()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if err = json.NewEncoder(w).Encode(entries); err != nil {
+		log.Printf("     encode json: %v", err)
+	}
+}
+
+// Directory entry with a different name, e.g. a mount, named
+// as the mount rather than as the shared directory.
+type namedEntry struct {
+	os.DirEntry
+	name string
+}
+
+func (e namedEntry) Name() string {
+	return e.name
+}
+
+// List mounts as directory entries for the top-level listing.
+func (s *Server) readMounts() ([]os.DirEntry, error) {
+	var (
+		entries []os.DirEntry
+		inf     os.FileInfo
+		err     error
+	)
 
-	if len(os.Args) > 1 {
-		a := os.Args[1]
-		if a == "help" || a == "--help" || a == "-h" {
-			fmt.Println(usage)
-			os.Exit(0)
+	for _, m := range s.mounts {
+		if inf, err = fs.Stat(m.fsys, "."); err != nil {
+			return nil, err
 		}
+		entries = append(entries, namedEntry{fs.FileInfoToDirEntry(inf), m.name})
+	}
 
-		i := 1
-		for i < len(os.Args) {
-			a = os.Args[i]
-			if a == "-r" {
-				recursive = true
-				i += 1
-				continue
-			}
+	return entries, nil
+}
 
-			if a == "-a" {
-				if i+1 < len(os.Args) {
-					addr = os.Args[i+1]
-					i += 2
-				} else {
-					fmt.Printf("missing argument for '-a'")
-					os.Exit(1)
-				}
-				continue
-			}
+// Stream a zip archive of the shared files in directory p.
+// In recursive mode subdirectories are included as well (up
+// to the maximum depth). Symlinked directories are skipped,
+// so that the archive can't grow endlessly through a loop.
+func (s *Server) serveCompressed(w http.ResponseWriter, r *http.Request, p *safePath) error {
+	var (
+		pr    *io.PipeReader
+		pw    *io.PipeWriter
+		count int
+		err   error
+	)
+
+	// fail before sending headers if directory is not readable
+	if _, err = fs.ReadDir(p.fsys, p.name); err != nil {
+		return err
+	}
 
-			root = os.Args[i]
-			i += 1
+	zipFilename := filepath.Base(p.abs) + ".zip"
+	w.Header().Set("Content-Disposition", attachment(zipFilename))
+	w.Header().Set("Content-Type", "application/zip")
+	// generated on the fly, downloads can't be resumed
+	w.Header().Set("Accept-Ranges", "none")
+
+	// archive is written by a separate goroutine, any error
+	// is passed on to the reader
+	pr, pw = io.Pipe()
+	go func() {
+		zw := zip.NewWriter(pw)
+		err := s.zipDir(zw, p, "", &count)
+		if err == nil {
+			err = zw.Close()
 		}
+		pw.CloseWithError(err)
+	}()
+
+	var archive io.Reader = pr
+	if s.bwlimit > 0 {
+		archive = newThrottledReader(r.Context(), pr, s.bwlimit)
 	}
 
-	// convert to absolute path (helps to make sure we don't share anything outside)
-	if root, err = filepath.Abs(root); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	if _, err = io.Copy(w, archive); err != nil {
+		// headers are already sent, client gets a truncated archive
+		pr.CloseWithError(err)
+		log.Printf("     zip [%s]: %v", p.abs, err)
+		return nil
 	}
 
-	if recursive {
-		log.Printf("sharing directory [%s] recursively", root)
-	} else {
-		log.Printf("sharing directory [%s]", root)
+	infof("     served %d compressed files in directory %s (%s)", count, p.rel, zipFilename)
+	return nil
+}
+
+// Add shared files of dir to the archive, with names prefixed
+// by prefix. Count is incremented for each file added.
+func (s *Server) zipDir(zw *zip.Writer, dir *safePath, prefix string, count *int) error {
+	entries, err := fs.ReadDir(dir.fsys, dir.name)
+	if err != nil {
+		return err
 	}
 
-	// home directory (where we can load html template and icon from)
-	if home, err = os.Executable(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	for _, e := range s.filterEntries(dir, entries) {
+		fp := dir.child(e.Name())
+
+		if e.IsDir() {
+			// requires credentials that weren't checked
+			if s.recursive && !protected(fp) {
+				if err = s.zipDir(zw, fp, prefix+e.Name()+"/", count); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// symlinks might point to directories or non-regular files,
+		// opening a fifo blocks
+		if inf, err := fs.Stat(fp.fsys, fp.name); err != nil || !inf.Mode().IsRegular() {
+			continue
+		}
+
+		if err = zipFile(zw, fp, prefix+e.Name()); err != nil {
+			return err
+		}
+		*count += 1
 	}
 
-	if home, err = filepath.EvalSymlinks(home); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	return nil
+}
+
+func zipFile(zw *zip.Writer, fp *safePath, name string) error {
+	f, err := fp.fsys.Open(fp.name)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	home, _ = filepath.Split(home)
-	log.Printf("found home directory [%s]", home)
+	inf, err := f.Stat()
+	if err != nil {
+		return err
+	}
 
-	mux = http.NewServeMux()
-	mux.HandleFunc("/", serve)
-	//handler := http.FileServer(http.Dir(root))
-	//mux.Handle("/", handler)
-	srv.Handler = mux
-	srv.Addr = addr
+	hdr, err := zip.FileInfoHeader(inf)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
 
-	log.Printf("serving at %s", srv.Addr)
-	if err = srv.ListenAndServe(); err != nil {
-		log.Fatalf("starting HTTP service: %s", err.Error())
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
 	}
+
+	_, err = io.Copy(dst, f)
+	return err
 }
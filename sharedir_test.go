@@ -0,0 +1,2260 @@
+package sharedir
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// requests are logged in verbose mode only
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// Create files in a temporary directory and return its path.
+// Keys are slash-separated paths, those ending with a slash are
+// created as directories.
+func testDir(t testing.TB, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Create server with cfg, failing the test if that fails.
+func testServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Config sharing dir, as with the defaults of the command line.
+func testConfig(dir ...string) Config {
+	cfg := DefaultConfig()
+	cfg.Dirs = dir
+	return cfg
+}
+
+// Send request to h and return the response. Headers are given
+// as pairs of name and value.
+func request(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	return send(h, httptest.NewRequest(method, target, nil), header...)
+}
+
+// Send request r to h with the headers and return the response.
+func send(h http.Handler, r *http.Request, header ...string) *httptest.ResponseRecorder {
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAbsURL(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.1/32")
+	cfg := testConfig(testDir(t, nil))
+	cfg.TrustedProxies = []*net.IPNet{proxy}
+	s := testServer(t, cfg)
+
+	forwarded := []string{"X-Forwarded-Proto", "https", "X-Forwarded-Host", "files.example.com", "X-Forwarded-For", "192.0.2.7"}
+
+	tests := []struct {
+		name   string
+		peer   string
+		header []string
+		want   string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "http://example.com/a.txt"},
+		{"untrusted peer", "192.0.2.1:1234", forwarded, "http://example.com/a.txt"},
+		{"trusted proxy", "10.0.0.1:1234", forwarded, "https://files.example.com/a.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				r.Header.Set(tt.header[i], tt.header[i+1])
+			}
+
+			if got := s.absURL(r, "/a.txt"); got != tt.want {
+				t.Errorf("%q, want %q", got, tt.want)
+			}
+
+			// TrustProxy replaces the address of the proxy
+			var got string
+			TrustProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = s.absURL(r, "/a.txt")
+			}), cfg.TrustedProxies).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("with TrustProxy: %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInRoot(t *testing.T) {
+	tests := []struct {
+		path string
+		root string
+		want bool
+	}{
+		{"/srv/shared", "/srv/shared", true},
+		{"/srv/shared/a", "/srv/shared", true},
+		{"/srv/shared/a/b", "/srv/shared", true},
+		{"/srv/shared-secret", "/srv/shared", false},
+		{"/srv/shared-secret/x", "/srv/shared", false},
+		{"/srv/sharedx", "/srv/shared", false},
+		{"/srv", "/srv/shared", false},
+		{"/a", "/", true},
+	}
+
+	for _, tt := range tests {
+		if got := inRoot(filepath.FromSlash(tt.path), filepath.FromSlash(tt.root)); got != tt.want {
+			t.Errorf("inRoot(%q, %q) = %t", tt.path, tt.root, got)
+		}
+	}
+}
+
+// Siblings of the shared directory whose names start with its
+// name must not be reachable.
+func TestParseSafePathSibling(t *testing.T) {
+	parent := testDir(t, map[string]string{
+		"shared/a.txt":        "a",
+		"shared-secret/x.txt": "x",
+	})
+	s := testServer(t, testConfig(filepath.Join(parent, "shared")))
+
+	for _, raw := range []string{"/../shared-secret/x.txt", "/../shared-secret", "/a/../../shared-secret/x.txt", "/.."} {
+		if sp := s.parseSafePath(raw); sp != nil {
+			t.Errorf("%s resolved to [%s]", raw, sp.abs)
+		}
+	}
+	if sp := s.parseSafePath("/a.txt"); sp == nil || sp.abs != filepath.Join(parent, "shared", "a.txt") {
+		t.Errorf("/a.txt resolved to %+v", sp)
+	}
+
+	// as sent by clients that don't clean paths
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.URL.Path = "/../shared-secret/x.txt"
+	if w := send(s, r); w.Code == http.StatusOK {
+		t.Errorf("status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{
+		"a.txt":  "text",
+		"b.html": "<p>html</p>",
+		"c.json": "{}",
+		"d":      "\x89PNG\r\n\x1a\n",
+	})))
+
+	tests := []struct {
+		target string
+		accept string
+		want   string
+	}{
+		{"/", "text/html", "text/html"},
+		{"/", "*/*", "text/plain"},
+		{"/", "application/json", "application/json"},
+		{"/a.txt", "*/*", "text/plain"},
+		{"/b.html", "*/*", "text/html"},
+		{"/c.json", "*/*", "application/json"},
+		{"/d", "*/*", "image/png"},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target, "Accept", tt.accept)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", tt.target, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.want) {
+			t.Errorf("%s: Content-Type %q, want %q", tt.target, ct, tt.want)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": content})))
+
+	w := request(s, http.MethodGet, "/a.txt", "Range", "bytes=10-20")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status %d", w.Code)
+	}
+	if got := w.Body.String(); got != content[10:21] {
+		t.Errorf("body %q, want %q", got, content[10:21])
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 10-20/36" {
+		t.Errorf("Content-Range %q", cr)
+	}
+
+	// a range of a file that changed since is not served
+	w = request(s, http.MethodGet, "/a.txt", "Range", "bytes=10-20", "If-Range", `"stale"`)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Errorf("stale If-Range: status %d, body %q", w.Code, w.Body)
+	}
+
+	if w = request(s, http.MethodGet, "/a.txt", "Range", "bytes=100-"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("beyond end: status %d", w.Code)
+	}
+}
+
+// File system whose directory "broken" can't be read.
+type brokenFS struct {
+	fstest.MapFS
+}
+
+func (f brokenFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == "broken" {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrPermission}
+	}
+	return f.MapFS.ReadDir(name)
+}
+
+func (f brokenFS) Open(name string) (fs.File, error) {
+	if name == "broken.txt" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f.MapFS.Open(name)
+}
+
+// A directory that can't be read fails the request, not the
+// server.
+func TestReadDirError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Recursive = true
+	cfg.FS = brokenFS{fstest.MapFS{
+		"a.txt":        {Data: []byte("a")},
+		"broken/b.txt": {Data: []byte("b")},
+	}}
+	s := testServer(t, cfg)
+
+	for _, accept := range []string{"text/html", "*/*", "application/json"} {
+		if w := request(s, http.MethodGet, "/broken/", "Accept", accept); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status %d", accept, w.Code)
+		}
+	}
+
+	if w := request(s, http.MethodGet, "/a.txt"); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Errorf("after failure: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestHead(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "0123456789", "sub/": ""})))
+
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		ctype  string
+	}{
+		{"file", "/a.txt", "*/*", "text/plain"},
+		{"listing", "/", "text/html", "text/html"},
+		{"text listing", "/", "*/*", "text/plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(s, http.MethodHead, tt.target, "Accept", tt.accept)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("body of %d bytes", w.Body.Len())
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.ctype) {
+				t.Errorf("Content-Type %q, want %q", ct, tt.ctype)
+			}
+		})
+	}
+
+	if cl := request(s, http.MethodHead, "/a.txt").Header().Get("Content-Length"); cl != "10" {
+		t.Errorf("Content-Length %q", cl)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	files := map[string]string{
+		"empty.txt": "",
+		"a.txt":     "0123456789",
+		"b.bin":     strings.Repeat("x", 100_000),
+	}
+	s := testServer(t, testConfig(testDir(t, files)))
+
+	for name, content := range files {
+		w := request(s, http.MethodGet, "/"+name)
+		if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(content)) {
+			t.Errorf("%s: Content-Length %q, want %d", name, cl, len(content))
+		}
+		if w.Body.Len() != len(content) {
+			t.Errorf("%s: body of %d bytes", name, w.Body.Len())
+		}
+	}
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "a"})
+	mod := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "a.txt"), mod, mod); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, testConfig(dir))
+
+	w := request(s, http.MethodGet, "/a.txt")
+	if lm := w.Header().Get("Last-Modified"); lm != mod.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified %q", lm)
+	}
+
+	tests := []struct {
+		name  string
+		since time.Time
+		code  int
+	}{
+		{"same time", mod, http.StatusNotModified},
+		{"later", mod.Add(time.Hour), http.StatusNotModified},
+		{"earlier", mod.Add(-time.Hour), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, "/a.txt", "If-Modified-Since", tt.since.Format(http.TimeFormat))
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if tt.code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s: body %q", tt.name, w.Body)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "a"})
+	s := testServer(t, testConfig(dir))
+
+	etag := request(s, http.MethodGet, "/a.txt").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	if w := request(s, http.MethodGet, "/a.txt", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("status %d", w.Code)
+	}
+	if w := request(s, http.MethodGet, "/a.txt", "If-None-Match", `"other", `+etag); w.Code != http.StatusNotModified {
+		t.Errorf("in list: status %d", w.Code)
+	}
+	if w := request(s, http.MethodGet, "/a.txt", "If-None-Match", `"other"`); w.Code != http.StatusOK {
+		t.Errorf("other ETag: status %d", w.Code)
+	}
+
+	// changes with the file
+	later := time.Now().Add(time.Hour)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("ab"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(dir, "a.txt"), later, later)
+	if w := request(s, http.MethodGet, "/a.txt", "If-None-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("modified: status %d", w.Code)
+	}
+}
+
+func TestListingJSON(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "abc", "sub/": ""})
+	mod := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(dir, "a.txt"), mod, mod)
+	s := testServer(t, testConfig(dir))
+
+	tests := []struct {
+		name   string
+		target string
+		accept string
+	}{
+		{"accept", "/", "application/json"},
+		{"query", "/?format=json", "text/html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(s, http.MethodGet, tt.target, "Accept", tt.accept)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type %q", ct)
+			}
+
+			var entries []map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Fatalf("%d entries", len(entries))
+			}
+			for _, e := range entries {
+				for _, k := range []string{"name", "size", "modtime", "isDir"} {
+					if _, ok := e[k]; !ok {
+						t.Errorf("entry %v without %q", e, k)
+					}
+				}
+			}
+
+			sub, file := entries[0], entries[1]
+			if sub["name"] != "sub" || sub["isDir"] != true {
+				t.Errorf("first entry %v", sub)
+			}
+			if file["name"] != "a.txt" || file["isDir"] != false || file["size"] != 3.0 || file["modtime"] != mod.Format(time.RFC3339) {
+				t.Errorf("second entry %v", file)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1, "1 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1025, "1.0 KiB"},
+		{4300, "4.2 KiB"},
+		{1024*1024 - 52, "1023.9 KiB"},
+		{1024*1024 - 1, "1.0 MiB"},
+		{1024 * 1024, "1.0 MiB"},
+		{1395864371, "1.3 GiB"},
+		{1 << 40, "1.0 TiB"},
+		{1 << 50, "1.0 PiB"},
+		{1 << 60, "1.0 EiB"},
+		{math.MaxInt64, "8.0 EiB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestListingSizes(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.bin": strings.Repeat("x", 4300), "sub/": ""})))
+
+	body := request(s, http.MethodGet, "/", "Accept", "text/html").Body.String()
+	if !strings.Contains(body, "4.2 KiB") {
+		t.Errorf("size of file not in listing")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	if Version == "" {
+		t.Fatal("no version")
+	}
+
+	cfg := testConfig(testDir(t, nil))
+	cfg.Prefix = "/share"
+	s := testServer(t, cfg)
+
+	w := request(s, http.MethodGet, "/share/~version")
+	if w.Code != http.StatusOK || w.Body.String() != Version+"\n" {
+		t.Errorf("status %d, body %q", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func TestMounts(t *testing.T) {
+	parent := testDir(t, map[string]string{
+		"docs/a.txt":      "a",
+		"photos/b.jpg":    "b",
+		"plain/c.txt":     "c",
+		"with=sign/d.txt": "d",
+	})
+	join := func(name string) string { return filepath.Join(parent, name) }
+
+	s := testServer(t, testConfig(
+		"documents="+join("docs"),
+		"pics="+join("photos"),
+		join("plain"),
+		join("with=sign"),
+	))
+
+	if got := listingNames(t, s, "/"); !slices.Equal(got, []string{"documents", "pics", "plain", "with=sign"}) {
+		t.Errorf("mounts %q", got)
+	}
+
+	tests := []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/documents/a.txt", http.StatusOK, "a"},
+		{"/pics/b.jpg", http.StatusOK, "b"},
+		{"/plain/c.txt", http.StatusOK, "c"},
+		{"/with=sign/d.txt", http.StatusOK, "d"},
+		{"/docs/a.txt", http.StatusBadRequest, ""},
+		{"/documents/../pics/b.jpg", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: status %d, body %q", tt.target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMountsInvalid(t *testing.T) {
+	parent := testDir(t, map[string]string{"a/": "", "b/": "", "x/a/": ""})
+	join := func(name string) string { return filepath.Join(parent, name) }
+
+	for _, dirs := range [][]string{
+		{join("a"), join("x/a")},
+		{"same=" + join("a"), "same=" + join("b")},
+		{"~stats=" + join("a"), join("b")},
+		{"..=" + join("a"), join("b")},
+		{join("missing")},
+	} {
+		if _, err := NewServer(testConfig(dirs...)); err == nil {
+			t.Errorf("%q accepted", dirs)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{
+		"below.txt": "123",
+		"at.txt":    "1234",
+		"above.txt": "12345",
+		"sub/":      "",
+	}))
+
+	tests := []struct {
+		max  int64
+		want []string // listed and served, others are too large
+	}{
+		{4, []string{"at.txt", "below.txt"}},
+		{3, []string{"below.txt"}},
+		{0, []string{"above.txt", "at.txt", "below.txt"}},
+	}
+
+	for _, tt := range tests {
+		cfg.MaxSize = tt.max
+		s := testServer(t, cfg)
+
+		if got := listingNames(t, s, "/"); !slices.Equal(got, append([]string{"sub"}, tt.want...)) {
+			t.Errorf("max %d: listing %q", tt.max, got)
+		}
+		for _, name := range []string{"below.txt", "at.txt", "above.txt"} {
+			code := http.StatusRequestEntityTooLarge
+			if slices.Contains(tt.want, name) {
+				code = http.StatusOK
+			}
+			if w := request(s, http.MethodGet, "/"+name); w.Code != code {
+				t.Errorf("max %d, %s: status %d, want %d", tt.max, name, w.Code, code)
+			}
+		}
+	}
+}
+
+// Names of the entries of the JSON listing of target.
+func listingNames(t *testing.T, h http.Handler, target string) []string {
+	t.Helper()
+
+	w := request(h, http.MethodGet, target, "Accept", "application/json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d", target, w.Code)
+	}
+
+	var entries []jsonEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	return names
+}
+
+func TestListingOrder(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{
+		"b.txt":  "",
+		"A.txt":  "",
+		"c.txt":  "",
+		"Zdir/":  "",
+		"adir/":  "",
+		"Bdir/":  "",
+		"_x.txt": "",
+	})))
+
+	want := []string{"adir", "Bdir", "Zdir", "_x.txt", "A.txt", "b.txt", "c.txt"}
+	if got := listingNames(t, s, "/"); !slices.Equal(got, want) {
+		t.Errorf("order %q, want %q", got, want)
+	}
+}
+
+func TestListingSort(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"small.txt":  "1",
+		"large.txt":  "1234567890",
+		"medium.txt": "12345",
+		"sub/":       "",
+	})
+	now := time.Now()
+	for i, name := range []string{"large.txt", "small.txt", "medium.txt"} {
+		mod := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(filepath.Join(dir, name), mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := testServer(t, testConfig(dir))
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"sort=size&order=desc", []string{"sub", "large.txt", "medium.txt", "small.txt"}},
+		{"sort=size", []string{"sub", "small.txt", "medium.txt", "large.txt"}},
+		{"sort=modified&order=asc", []string{"sub", "large.txt", "small.txt", "medium.txt"}},
+		{"sort=modified&order=desc", []string{"sub", "medium.txt", "small.txt", "large.txt"}},
+		{"sort=name&order=desc", []string{"sub", "small.txt", "medium.txt", "large.txt"}},
+		{"sort=bogus&order=bogus", []string{"sub", "large.txt", "medium.txt", "small.txt"}},
+	}
+
+	for _, tt := range tests {
+		if got := listingNames(t, s, "/?"+tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// column headers toggle the order
+	body := request(s, http.MethodGet, "/?sort=size", "Accept", "text/html").Body.String()
+	if !strings.Contains(body, "order=desc&amp;sort=size") {
+		t.Errorf("no link sorting by size in descending order")
+	}
+}
+
+func TestHidden(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.txt":        "a",
+		".secret":      "s",
+		".git/config":  "c",
+		"sub/.hidden":  "h",
+		"sub/shown.md": "m",
+	})
+
+	tests := []struct {
+		hidden  bool
+		listing []string
+		code    int
+	}{
+		{false, []string{"sub", "a.txt"}, http.StatusNotFound},
+		{true, []string{".git", "sub", ".secret", "a.txt"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("hidden=%t", tt.hidden), func(t *testing.T) {
+			cfg := testConfig(dir)
+			cfg.Recursive = true
+			cfg.Hidden = tt.hidden
+			s := testServer(t, cfg)
+
+			if got := listingNames(t, s, "/"); !slices.Equal(got, tt.listing) {
+				t.Errorf("listing %q, want %q", got, tt.listing)
+			}
+			for _, target := range []string{"/.secret", "/.git/config", "/sub/.hidden", "/.git/"} {
+				if w := request(s, http.MethodGet, target); w.Code != tt.code {
+					t.Errorf("%s: status %d, want %d", target, w.Code, tt.code)
+				}
+			}
+			if w := request(s, http.MethodGet, "/sub/shown.md"); w.Code != http.StatusOK {
+				t.Errorf("/sub/shown.md: status %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	outside := testDir(t, map[string]string{"passwd": "root:x:0:0"})
+	dir := testDir(t, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	links := map[string]string{
+		"escape":     filepath.Join(outside, "passwd"),
+		"escape-dir": outside,
+		"inside":     filepath.Join(dir, "a.txt"),
+		"inside-dir": filepath.Join(dir, "sub"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+
+	tests := []struct {
+		follow bool
+		target string
+		code   int
+	}{
+		{false, "/escape", http.StatusForbidden},
+		{false, "/escape-dir/passwd", http.StatusForbidden},
+		{false, "/inside", http.StatusForbidden},
+		{false, "/inside-dir/b.txt", http.StatusForbidden},
+		{true, "/escape", http.StatusForbidden},
+		{true, "/escape-dir/passwd", http.StatusForbidden},
+		{true, "/inside", http.StatusOK},
+		{true, "/inside-dir/b.txt", http.StatusOK},
+		{true, "/a.txt", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(dir)
+		cfg.Recursive = true
+		cfg.FollowSymlinks = tt.follow
+		s := testServer(t, cfg)
+
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != tt.code {
+			t.Errorf("%s (follow %t): status %d, want %d", tt.target, tt.follow, w.Code, tt.code)
+		}
+		if strings.Contains(w.Body.String(), "root:x") {
+			t.Errorf("%s (follow %t): served file outside", tt.target, tt.follow)
+		}
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	cfg := testConfig(testDir(t, nil))
+	cfg.Prefix = "/share"
+	s := testServer(t, cfg)
+
+	w := request(s, http.MethodGet, "/share/~favicon.ico")
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if !bytes.Equal(w.Body.Bytes(), icon) {
+		t.Error("not the embedded icon")
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/x-icon" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "max-age") {
+		t.Errorf("Cache-Control %q", cc)
+	}
+}
+
+// Listing of a directory with many entries, rendered with the
+// template parsed once by NewServer.
+func BenchmarkListing(b *testing.B) {
+	benchmarkListing(b, false)
+}
+
+// Same listing, kept rendered between requests.
+func BenchmarkListingCached(b *testing.B) {
+	benchmarkListing(b, true)
+}
+
+func benchmarkListing(b *testing.B, cached bool) {
+	files := make(map[string]string)
+	for i := range 200 {
+		files[fmt.Sprintf("file-%03d.txt", i)] = "x"
+	}
+	cfg := testConfig(testDir(b, files))
+	cfg.CacheListings = cached
+	s := testServer(b, cfg)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "text/html")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+}
+
+// What each listing cost when the template was parsed per request.
+func BenchmarkParseTemplate(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := parseTemplate(""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHref(t *testing.T) {
+	tests := []struct {
+		rel  string
+		name string
+		want string
+	}{
+		{"", "a.txt", "a.txt"},
+		{"", "my file (1).txt", "my%20file%20%281%29.txt"},
+		{"", "a#b.txt", "a%23b.txt"},
+		{"", "what?.txt", "what%3F.txt"},
+		{"", "100%.txt", "100%25.txt"},
+		{"", "café.txt", "caf%C3%A9.txt"},
+		{"", "日本.txt", "%E6%97%A5%E6%9C%AC.txt"},
+		{"sub dir/x#y", "a b.txt", "sub%20dir/x%23y/a%20b.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := (listingData{rel: tt.rel}).Href(tt.name); got != tt.want {
+			t.Errorf("Href(%q) in %q = %q, want %q", tt.name, tt.rel, got, tt.want)
+		}
+	}
+}
+
+// Links in listings lead to the files, whatever their names.
+func TestHrefRequest(t *testing.T) {
+	names := []string{"my file (1).txt", "a#b.txt", "what?.txt", "100%.txt", "café.txt", "日本.txt", "a+b&c=d.txt"}
+	files := make(map[string]string)
+	for _, n := range names {
+		files["sub dir/"+n] = n
+	}
+	cfg := testConfig(testDir(t, files))
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	// as the browser sees it
+	body := html.UnescapeString(request(s, http.MethodGet, "/sub%20dir/", "Accept", "text/html").Body.String())
+	for _, n := range names {
+		href := (listingData{rel: "sub dir"}).Href(n)
+		if !strings.Contains(body, `href="/`+href+`"`) {
+			t.Errorf("%s: no link %q in listing", n, href)
+		}
+
+		w := request(s, http.MethodGet, "/"+href)
+		if w.Code != http.StatusOK || w.Body.String() != n {
+			t.Errorf("%s: status %d, body %q", n, w.Code, w.Body)
+		}
+	}
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	want := []breadcrumb{
+		{"/", ""},
+		{"a", "a/"},
+		{"b c", "a/b%20c/"},
+		{"d", "a/b%20c/d/"},
+	}
+	if got := (listingData{rel: "a/b c/d"}).Breadcrumbs(); !slices.Equal(got, want) {
+		t.Errorf("%q, want %q", got, want)
+	}
+	if got := (listingData{}).Breadcrumbs(); !slices.Equal(got, want[:1]) {
+		t.Errorf("root: %q", got)
+	}
+
+	// rendered as links
+	cfg := testConfig(testDir(t, map[string]string{"a/b c/d/": ""}))
+	cfg.Recursive = true
+	cfg.Prefix = "/share"
+	s := testServer(t, cfg)
+
+	body := request(s, http.MethodGet, "/share/a/b%20c/d/", "Accept", "text/html").Body.String()
+	for _, c := range want {
+		if link := `href="/share/` + c.Href + `"`; !strings.Contains(body, link) {
+			t.Errorf("no breadcrumb %s", link)
+		}
+	}
+}
+
+func TestParentLink(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{"sub/deep/a.txt": "a"}))
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		parent string // empty if there is none
+	}{
+		{"/", ""},
+		{"/sub/", "/"},
+		{"/sub/deep/", "/sub/"},
+	}
+
+	for _, tt := range tests {
+		body := request(s, http.MethodGet, tt.target, "Accept", "text/html").Body.String()
+		hasParent := strings.Contains(body, ">..</a>")
+		if hasParent != (tt.parent != "") {
+			t.Errorf("%s: parent link shown: %t", tt.target, hasParent)
+		}
+		if tt.parent != "" && !strings.Contains(body, `<a href="`+tt.parent+`">..</a>`) {
+			t.Errorf("%s: no link to %s", tt.target, tt.parent)
+		}
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"f0.txt":         "0",
+		"a/f1.txt":       "1",
+		"a/b/f2.txt":     "2",
+		"a/b/c/f3.txt":   "3",
+		"a/b/c/d/f4.txt": "4",
+	})
+
+	tests := []struct {
+		depth  int
+		target string
+		code   int
+	}{
+		{0, "/f0.txt", http.StatusOK},
+		{0, "/a/", http.StatusForbidden},
+		{0, "/a/f1.txt", http.StatusForbidden},
+		{2, "/a/b/", http.StatusOK},
+		{2, "/a/b/f2.txt", http.StatusOK},
+		{2, "/a/b/c/", http.StatusForbidden},
+		{2, "/a/b/c/f3.txt", http.StatusForbidden},
+		{-1, "/a/b/c/d/f4.txt", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(dir)
+		cfg.Recursive = true
+		cfg.MaxDepth = tt.depth
+		s := testServer(t, cfg)
+
+		if w := request(s, http.MethodGet, tt.target); w.Code != tt.code {
+			t.Errorf("depth %d, %s: status %d, want %d", tt.depth, tt.target, w.Code, tt.code)
+		}
+	}
+
+	// directories beyond the limit are not listed
+	cfg := testConfig(dir)
+	cfg.Recursive = true
+	cfg.MaxDepth = 1
+	s := testServer(t, cfg)
+	if got := listingNames(t, s, "/a/"); !slices.Equal(got, []string{"f1.txt"}) {
+		t.Errorf("listing at the limit %q", got)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.jpg":    "a",
+		"b.JPG":    "b",
+		"c.png":    "c",
+		"d.txt":    "d",
+		"e":        "e",
+		"sub/":     "",
+		"f.tar.gz": "f",
+	})
+
+	tests := []struct {
+		name  string
+		allow []string
+		block []string
+		want  []string // listed and served, all others 404
+	}{
+		{"none", nil, nil, []string{"a.jpg", "b.JPG", "c.png", "d.txt", "e", "f.tar.gz"}},
+		{"allow", []string{".jpg", ".png"}, nil, []string{"a.jpg", "b.JPG", "c.png"}},
+		{"block", nil, []string{".txt", ".gz"}, []string{"a.jpg", "b.JPG", "c.png", "e"}},
+		{"both", []string{".jpg", ".png"}, []string{".png"}, []string{"a.jpg", "b.JPG"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(dir)
+			cfg.Extensions = tt.allow
+			cfg.NoExtensions = tt.block
+			s := testServer(t, cfg)
+
+			// directories are listed regardless
+			if got := listingNames(t, s, "/"); !slices.Equal(got, append([]string{"sub"}, tt.want...)) {
+				t.Errorf("listing %q", got)
+			}
+			for _, name := range []string{"a.jpg", "b.JPG", "c.png", "d.txt", "e", "f.tar.gz"} {
+				code := http.StatusNotFound
+				if slices.Contains(tt.want, name) {
+					code = http.StatusOK
+				}
+				if w := request(s, http.MethodGet, "/"+name); w.Code != code {
+					t.Errorf("%s: status %d, want %d", name, w.Code, code)
+				}
+			}
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	files := make(map[string]string)
+	for i := range 25 {
+		files[fmt.Sprintf("f%02d.txt", i)] = ""
+	}
+	s := testServer(t, testConfig(testDir(t, files)))
+
+	// names of files from up to (not including) to
+	names := func(from, to int) []string {
+		var names []string
+		for i := from; i != to; {
+			names = append(names, fmt.Sprintf("f%02d.txt", i))
+			if from < to {
+				i++
+			} else {
+				i--
+			}
+		}
+		return names
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", names(0, 25)},
+		{"per=10", names(0, 10)},
+		{"page=2&per=10", names(10, 20)},
+		{"page=3&per=10", names(20, 25)},
+		{"page=9&per=10", names(20, 25)},
+		{"page=0&per=10", names(0, 10)},
+		{"page=2&per=bogus", names(0, 25)},
+		{"page=2&per=10&order=desc", names(14, 4)},
+	}
+
+	for _, tt := range tests {
+		if got := listingNames(t, s, "/?"+tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// links to the previous and next pages keep the page size
+	links := []struct {
+		query string
+		want  []string
+		not   []string
+	}{
+		{"per=10", []string{"page 1 of 3", "?order=asc&amp;page=2&amp;per=10&amp;sort=name"}, []string{"previous"}},
+		{"page=2&per=10", []string{"page 2 of 3", "?order=asc&amp;per=10&amp;sort=name\">previous", "?order=asc&amp;page=3&amp;per=10&amp;sort=name\">next"}, nil},
+		{"page=3&per=10", []string{"page 3 of 3", "previous"}, []string{"next"}},
+		{"per=100", nil, []string{"page 1 of"}},
+	}
+
+	for _, tt := range links {
+		body := request(s, http.MethodGet, "/?"+tt.query, "Accept", "text/html").Body.String()
+		for _, l := range tt.want {
+			if !strings.Contains(body, l) {
+				t.Errorf("%q: no %q", tt.query, l)
+			}
+		}
+		for _, l := range tt.not {
+			if strings.Contains(body, l) {
+				t.Errorf("%q: unexpected %q", tt.query, l)
+			}
+		}
+	}
+}
+
+func TestListingText(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{
+		"b.txt":        "",
+		"a file.txt":   "",
+		"sub/":         "",
+		"sub/deep.txt": "",
+	})))
+
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		text   bool
+	}{
+		{"curl", "/", "*/*", true},
+		{"no accept", "/", "", true},
+		{"browser", "/", "text/html,application/xhtml+xml,*/*;q=0.8", false},
+		{"json", "/", "application/json", false},
+		{"format param", "/?format=text", "text/html", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(s, http.MethodGet, tt.target, "Accept", tt.accept)
+			text := strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain")
+			if w.Code != http.StatusOK || text != tt.text {
+				t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+			}
+			if want := "sub/\na file.txt\nb.txt\n"; text && w.Body.String() != want {
+				t.Errorf("body %q, want %q", w.Body, want)
+			}
+		})
+	}
+}
+
+func TestDownloadParam(t *testing.T) {
+	names := []string{"plain.txt", "with space.txt", `with "quotes".txt`, "bäckslash\\.txt"}
+	files := make(map[string]string)
+	for _, name := range names {
+		files[name] = "content"
+	}
+	s := testServer(t, testConfig(testDir(t, files)))
+
+	if d := request(s, http.MethodGet, "/plain.txt").Header().Get("Content-Disposition"); d != "" {
+		t.Errorf("without param: Content-Disposition %q", d)
+	}
+	if d := request(s, http.MethodGet, "/plain.txt?download=1").Header().Get("Content-Disposition"); d != `attachment; filename=plain.txt` {
+		t.Errorf("plain: Content-Disposition %q", d)
+	}
+
+	for _, name := range names {
+		w := request(s, http.MethodGet, "/"+url.PathEscape(name)+"?download=1")
+		if w.Code != http.StatusOK || w.Body.String() != "content" {
+			t.Fatalf("%s: status %d", name, w.Code)
+		}
+
+		d := w.Header().Get("Content-Disposition")
+		typ, params, err := mime.ParseMediaType(d)
+		if err != nil || typ != "attachment" || params["filename"] != name {
+			t.Errorf("%s: Content-Disposition %q parsed as %q, %q, %v", name, d, typ, params, err)
+		}
+	}
+}
+
+func TestEncodedNames(t *testing.T) {
+	parent := testDir(t, map[string]string{
+		"shared/a b.txt":        "space",
+		"shared/(x).txt":        "parens",
+		"shared/#1.txt":         "hash",
+		"shared/a+b.txt":        "plus",
+		"shared/100%.txt":       "percent",
+		"shared/файл.txt":       "cyrillic",
+		"shared/😀.txt":          "emoji",
+		"shared/dir ü/file.txt": "nested",
+		"secret.txt":            "secret",
+	})
+	cfg := testConfig(filepath.Join(parent, "shared"))
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/a%20b.txt", "space"},
+		{"/%28x%29.txt", "parens"},
+		{"/%231.txt", "hash"},
+		{"/a%2Bb.txt", "plus"},
+		{"/a+b.txt", "plus"},
+		{"/100%25.txt", "percent"},
+		{"/%D1%84%D0%B0%D0%B9%D0%BB.txt", "cyrillic"},
+		{"/%F0%9F%98%80.txt", "emoji"},
+		{"/dir%20%C3%BC/file.txt", "nested"},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s: status %d, body %q", tt.target, w.Code, w.Body)
+		}
+	}
+
+	// ".." is rejected after decoding
+	for _, target := range []string{"/%2E%2E/secret.txt", "/%2e%2e%2fsecret.txt", "/dir%20%C3%BC/%2E%2E/%2E%2E/secret.txt"} {
+		if w := request(s, http.MethodGet, target); w.Code == http.StatusOK {
+			t.Errorf("%s: status %d, body %q", target, w.Code, w.Body)
+		}
+	}
+}
+
+// Query strings are not part of the path.
+func TestQueryString(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{
+		"a.txt":     "a",
+		"what?.txt": "question",
+		"sub/b.txt": "b",
+	}))
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/a.txt?x=1", "a"},
+		{"/a.txt?", "a"},
+		{"/a.txt?x=/../../etc/passwd", "a"},
+		{"/sub/b.txt?download=1&x=%20", "b"},
+		{"/what%3F.txt?x=1", "question"},
+		{"/sub/?sort=size&order=desc&format=text", "b.txt\n"},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s: status %d, body %q", tt.target, w.Code, w.Body)
+		}
+	}
+}
+
+// Names and contents of the files in a zip archive.
+func zipContents(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+func TestZip(t *testing.T) {
+	outside := testDir(t, map[string]string{"passwd": "root:x:0:0"})
+	dir := testDir(t, map[string]string{
+		"a.txt":            "a",
+		".hidden":          "h",
+		"sub/b.txt":        "b",
+		"sub/deeper/c.txt": "c",
+		"priv/" + authFile: "u:p\n",
+		"priv/secret.txt":  "s",
+		"empty/":           "",
+	})
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(dir, "escape")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	tests := []struct {
+		recursive bool
+		target    string
+		filename  string
+		want      map[string]string
+	}{
+		{false, "/?zip=1", filepath.Base(dir) + ".zip", map[string]string{"a.txt": "a"}},
+		{true, "/?download=zip", filepath.Base(dir) + ".zip", map[string]string{"a.txt": "a", "sub/b.txt": "b", "sub/deeper/c.txt": "c"}},
+		{true, "/sub/?zip=1", "sub.zip", map[string]string{"b.txt": "b", "deeper/c.txt": "c"}},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(dir)
+		cfg.Recursive = tt.recursive
+		cfg.FollowSymlinks = true
+		s := testServer(t, cfg)
+
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("%s: status %d, Content-Type %q", tt.target, w.Code, w.Header().Get("Content-Type"))
+		}
+
+		if _, params, _ := mime.ParseMediaType(w.Header().Get("Content-Disposition")); params["filename"] != tt.filename {
+			t.Errorf("%s: Content-Disposition %q", tt.target, w.Header().Get("Content-Disposition"))
+		}
+
+		if got := zipContents(t, w.Body.Bytes()); !maps.Equal(got, tt.want) {
+			t.Errorf("%s (recursive %t): %q, want %q", tt.target, tt.recursive, got, tt.want)
+		}
+	}
+}
+
+func TestServeFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		html   bool
+	}{
+		{"browser", "text/html,application/xhtml+xml,*/*;q=0.8", true},
+		{"curl", "*/*", false},
+		{"none", "", false},
+		{"json", "application/json", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/missing", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			serveFailure(w, r, http.StatusNotFound, "no such <file>")
+
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status %d", w.Code)
+			}
+			body := w.Body.String()
+			if tt.html {
+				if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+					t.Errorf("Content-Type %q", ct)
+				}
+				for _, want := range []string{"<!DOCTYPE html>", "404 Not Found", "no such &lt;file&gt;"} {
+					if !strings.Contains(body, want) {
+						t.Errorf("no %q in %q", want, body)
+					}
+				}
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") || body != "no such <file>" {
+				t.Errorf("Content-Type %q, body %q", ct, body)
+			}
+		})
+	}
+}
+
+func TestMimeTypes(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.md":    "# title",
+		"b.log":   "log",
+		"c.go":    "package main",
+		"d.txt":   "text",
+		"e.LOG":   "log",
+		"f.bogus": "\x00\x01\x02",
+	})
+	cfg := testConfig(dir)
+	cfg.MimeTypes = map[string]string{
+		".log": "text/x-log",
+		".txt": "text/x-custom",
+	}
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/a.md", "text/markdown; charset=utf-8"},
+		{"/b.log", "text/x-log"},
+		{"/c.go", "text/plain; charset=utf-8"},
+		{"/d.txt", "text/x-custom"},
+		{"/e.LOG", "text/x-log"},
+		{"/f.bogus", defaultMimeType},
+	}
+
+	for _, tt := range tests {
+		if ct := request(s, http.MethodGet, tt.target).Header().Get("Content-Type"); ct != tt.want {
+			t.Errorf("%s: Content-Type %q, want %q", tt.target, ct, tt.want)
+		}
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"site/index.html": "<p>home</p>",
+		"site/page.html":  "page",
+		"docs/start.html": "start",
+		"docs/a.txt":      "a",
+		"plain/a.txt":     "a",
+		"dir/index.html/": "",
+	})
+
+	tests := []struct {
+		index  string
+		target string
+		code   int
+		body   string // empty if a listing is expected
+	}{
+		{"index.html", "/site/", http.StatusOK, "<p>home</p>"},
+		{"index.html", "/site/?list=1", http.StatusOK, ""},
+		{"index.html", "/site", http.StatusMovedPermanently, ""},
+		{"index.html", "/plain/", http.StatusOK, ""},
+		{"index.html", "/dir/", http.StatusOK, ""},
+		{"start.html", "/docs/", http.StatusOK, "start"},
+		{"start.html", "/site/", http.StatusOK, ""},
+		{"", "/site/", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(dir)
+		cfg.Recursive = true
+		cfg.IndexFile = tt.index
+		s := testServer(t, cfg)
+
+		w := request(s, http.MethodGet, tt.target, "Accept", "text/html")
+		if w.Code != tt.code {
+			t.Errorf("%s (index %q): status %d, want %d", tt.target, tt.index, w.Code, tt.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if listing := strings.Contains(w.Body.String(), "<table"); listing != (tt.body == "") || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s (index %q): body %q", tt.target, tt.index, w.Body)
+		}
+	}
+}
+
+// Servers don't share state, several can serve at the same time.
+func TestServersIndependent(t *testing.T) {
+	dirA := testDir(t, map[string]string{"a.txt": "a", "sub/x.txt": "x"})
+	dirB := testDir(t, map[string]string{"b.txt": "b", "sub/x.txt": "y"})
+
+	cfgA := testConfig(dirA)
+	cfgA.Recursive = true
+	a := testServer(t, cfgA)
+	b := testServer(t, testConfig(dirB))
+
+	tests := []struct {
+		s      *Server
+		target string
+		code   int
+		body   string
+	}{
+		{a, "/a.txt", http.StatusOK, "a"},
+		{a, "/b.txt", http.StatusNotFound, ""},
+		{a, "/sub/x.txt", http.StatusOK, "x"},
+		{b, "/b.txt", http.StatusOK, "b"},
+		{b, "/a.txt", http.StatusNotFound, ""},
+		{b, "/sub/x.txt", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			t.Parallel()
+			for range 20 {
+				w := request(tt.s, http.MethodGet, tt.target)
+				if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+					t.Fatalf("status %d, body %q", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	}))
+	cfg.Recursive = true
+	cfg.Prefix = "/share"
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target   string
+		code     int
+		body     string
+		location string
+	}{
+		{"/share/a.txt", http.StatusOK, "a", ""},
+		{"/share/sub/b.txt", http.StatusOK, "b", ""},
+		{"/share/sub/?format=text", http.StatusOK, "b.txt\n", ""},
+		{"/share", http.StatusMovedPermanently, "", "/share/"},
+		{"/share/sub?x=1", http.StatusMovedPermanently, "", "/share/sub/?x=1"},
+		{"/a.txt", http.StatusNotFound, "", ""},
+		{"/shared/a.txt", http.StatusNotFound, "", ""},
+		{"/share/../a.txt", http.StatusBadRequest, "", ""},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: status %d, body %q", tt.target, w.Code, w.Body)
+		}
+		if loc := w.Header().Get("Location"); loc != tt.location {
+			t.Errorf("%s: Location %q, want %q", tt.target, loc, tt.location)
+		}
+	}
+
+	// links of the listing start with the prefix
+	body := request(s, http.MethodGet, "/share/", "Accept", "text/html").Body.String()
+	for _, link := range []string{`href="/share/a.txt"`, `href="/share/sub/"`, `href="/share/~favicon.ico"`} {
+		if !strings.Contains(body, link) {
+			t.Errorf("no %s in listing", link)
+		}
+	}
+	if strings.Contains(body, `href="/a.txt"`) {
+		t.Error("link without prefix")
+	}
+}
+
+func TestRedirectDir(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{
+		"a.txt":      "a",
+		"sub/":       "",
+		"a b/c/":     "",
+		"sub/of.txt": "",
+	}))
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		method   string
+		target   string
+		code     int
+		location string
+	}{
+		{http.MethodGet, "/sub", http.StatusMovedPermanently, "/sub/"},
+		{http.MethodHead, "/sub", http.StatusMovedPermanently, "/sub/"},
+		{http.MethodGet, "/sub?sort=size", http.StatusMovedPermanently, "/sub/?sort=size"},
+		{http.MethodGet, "/a%20b/c", http.StatusMovedPermanently, "/a%20b/c/"},
+		{http.MethodGet, "/sub/", http.StatusOK, ""},
+		{http.MethodGet, "/a.txt", http.StatusOK, ""},
+		{http.MethodGet, "/missing", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		w := request(s, tt.method, tt.target)
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s: status %d, Location %q", tt.method, tt.target, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestListingCache(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "a"})
+	cfg := testConfig(dir)
+	cfg.CacheListings = true
+	s := testServer(t, cfg)
+
+	// in case the file system has coarse timestamps
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() string {
+		w := request(s, http.MethodGet, "/", "Accept", "text/plain")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if body := get(); body != "a.txt\n" {
+		t.Fatalf("first: %q", body)
+	}
+
+	// not noticed while the directory seems unchanged
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(dir, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); body != "a.txt\n" {
+		t.Fatalf("cached: %q", body)
+	}
+
+	// other formats are kept apart
+	if names := listingNames(t, s, "/"); !slices.Equal(names, []string{"a.txt", "b.txt"}) {
+		t.Errorf("json: %q", names)
+	}
+
+	mod := time.Now()
+	if err := os.Chtimes(dir, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); body != "a.txt\nb.txt\n" {
+		t.Errorf("after the directory changed: %q", body)
+	}
+}
+
+func TestFS(t *testing.T) {
+	mod := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cfg := DefaultConfig()
+	cfg.Recursive = true
+	cfg.FS = fstest.MapFS{
+		"a.txt":        {Data: []byte("hello"), ModTime: mod},
+		"sub/b.json":   {Data: []byte("{}")},
+		".hidden":      {Data: []byte("h")},
+		"sub/deep/c.c": {Data: []byte("int x;")},
+	}
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/a.txt", http.StatusOK, "hello"},
+		{"/sub/b.json", http.StatusOK, "{}"},
+		{"/sub/deep/c.c", http.StatusOK, "int x;"},
+		{"/sub/?format=text", http.StatusOK, "deep/\nb.json\n"},
+		{"/?format=text", http.StatusOK, "sub/\na.txt\n"},
+		{"/.hidden", http.StatusNotFound, ""},
+		{"/missing", http.StatusNotFound, ""},
+		{"/../a.txt", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: status %d, body %q", tt.target, w.Code, w.Body)
+		}
+	}
+
+	w := request(s, http.MethodGet, "/a.txt")
+	if lm := w.Header().Get("Last-Modified"); lm != mod.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified %q", lm)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	// there is no directory to write to
+	cfg.Upload = true
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("upload into fs.FS accepted")
+	}
+}
+
+// Writer of a response that blocks writing the body until
+// release is closed, so that the transfer stays active.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{} // closed on the first write
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	select {
+	case <-w.writing:
+	default:
+		close(w.writing)
+	}
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestMaxTransfers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxTransfers = 1
+	cfg.FS = brokenFS{fstest.MapFS{
+		"a.txt":      {Data: []byte("a")},
+		"b.txt":      {Data: []byte("b")},
+		"broken.txt": {Data: []byte("x")},
+	}}
+	s := testServer(t, cfg)
+
+	// failures give their slot back
+	for range 3 {
+		if w := request(s, http.MethodGet, "/broken.txt"); w.Code != http.StatusInternalServerError {
+			t.Fatalf("broken: status %d", w.Code)
+		}
+	}
+
+	bw := &blockingWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		s.ServeHTTP(bw, httptest.NewRequest(http.MethodGet, "/a.txt", nil))
+		close(done)
+	}()
+	<-bw.writing
+
+	w := request(s, http.MethodGet, "/b.txt")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("over the limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// listings are not transfers
+	if w := request(s, http.MethodGet, "/"); w.Code != http.StatusOK {
+		t.Errorf("listing: status %d", w.Code)
+	}
+
+	close(bw.release)
+	<-done
+	if bw.Code != http.StatusOK || bw.Body.String() != "a" {
+		t.Errorf("first: status %d, body %q", bw.Code, bw.Body)
+	}
+
+	if w := request(s, http.MethodGet, "/b.txt"); w.Code != http.StatusOK {
+		t.Errorf("after the first: status %d", w.Code)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "a"})
+	cfg := testConfig(dir)
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	// the file system is not accessed
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(s, http.MethodGet, "/~health")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	var v struct {
+		Status    string   `json:"status"`
+		Uptime    *float64 `json:"uptime"`
+		Version   string   `json:"version"`
+		Roots     []string `json:"roots"`
+		Recursive bool     `json:"recursive"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Status != "ok" || v.Uptime == nil || *v.Uptime < 0 || v.Version != Version || !slices.Equal(v.Roots, []string{dir}) || !v.Recursive {
+		t.Errorf("health %s", w.Body)
+	}
+}
+
+func TestNoListing(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	}))
+	cfg.Recursive = true
+	cfg.NoListing = true
+	cfg.Manifest = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/a.txt", http.StatusOK},
+		{"/sub/b.txt", http.StatusOK},
+		{"/", http.StatusForbidden},
+		{"/sub/", http.StatusForbidden},
+		{"/?format=json", http.StatusForbidden},
+		{"/?zip=1", http.StatusForbidden},
+		{"/~search?q=b", http.StatusForbidden},
+		{"/~manifest", http.StatusForbidden},
+		{"/~stats", http.StatusForbidden},
+		{"/missing.txt", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target, "Accept", "text/html")
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.code)
+		}
+		if tt.code == http.StatusForbidden && strings.Contains(w.Body.String(), "b.txt") {
+			t.Errorf("%s: names revealed", tt.target)
+		}
+	}
+}
+
+func TestSniffMimeType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 600)
+	text := "#!/bin/sh\necho " + strings.Repeat("hello ", 200) + "\n"
+	s := testServer(t, testConfig(testDir(t, map[string]string{
+		"script":      text,
+		"image":       png,
+		"empty":       "",
+		"binary":      "\x00\x01\x02\x03",
+		"unknown.zzz": "plain words",
+	})))
+
+	tests := []struct {
+		target string
+		want   string
+		body   string
+	}{
+		{"/script", "text/plain; charset=utf-8", text},
+		{"/image", "image/png", png},
+		{"/empty", "text/plain; charset=utf-8", ""},
+		{"/binary", defaultMimeType, "\x00\x01\x02\x03"},
+		{"/unknown.zzz", "text/plain; charset=utf-8", "plain words"},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target)
+		if ct := w.Header().Get("Content-Type"); w.Code != http.StatusOK || ct != tt.want {
+			t.Errorf("%s: status %d, Content-Type %q, want %q", tt.target, w.Code, ct, tt.want)
+		}
+		// the bytes sniffed are sent as well
+		if w.Body.String() != tt.body {
+			t.Errorf("%s: %d bytes, want %d", tt.target, w.Body.Len(), len(tt.body))
+		}
+	}
+
+	if w := request(s, http.MethodGet, "/script", "Range", "bytes=0-8"); w.Code != http.StatusPartialContent || w.Body.String() != "#!/bin/sh" {
+		t.Errorf("range: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestGuessMimeType(t *testing.T) {
+	// like many system tables, which browsers then download
+	if err := mime.AddExtensionType(".sql", "application/sql"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(testDir(t, nil))
+	cfg.MimeTypes = map[string]string{".md": "text/plain", ".pdf": "application/x-custom"}
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		name    string
+		file    string
+		content string // nil reader if empty
+		want    string
+	}{
+		{"override before built-in", "a.md", "", "text/plain"},
+		{"override before system", "a.pdf", "", "application/x-custom"},
+		{"built-in", "a.go", "", "text/plain; charset=utf-8"},
+		{"built-in before system", "a.sql", "", "text/plain; charset=utf-8"},
+		{"system", "a.png", "", "image/png"},
+		{"extension before content", "a.png", "plain text", "image/png"},
+		{"content", "README", "plain text", "text/plain; charset=utf-8"},
+		{"unknown extension, content", "a.zzz", "\x89PNG\r\n\x1a\n", "image/png"},
+		{"nothing known", "a.zzz", "", defaultMimeType},
+		{"binary content", "data", "\x00\x01\x02", defaultMimeType},
+	}
+
+	for _, tt := range tests {
+		var content io.ReadSeeker
+		if tt.content != "" {
+			content = strings.NewReader(tt.content)
+		}
+		if got, err := s.guessMimeType(tt.file, content); err != nil || got != tt.want {
+			t.Errorf("%s: %s: %q, %v, want %q", tt.name, tt.file, got, err, tt.want)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "a"})))
+	metric := regexp.MustCompile(`^([a-z]+);dur=(\d+\.\d{2})$`)
+
+	tests := []struct {
+		target string
+		accept string
+		want   []string
+	}{
+		{"/a.txt", "*/*", []string{"stat", "open", "type"}},
+		{"/", "text/html", []string{"stat", "read", "render"}},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target, "Accept", tt.accept)
+		h := w.Header().Get("Server-Timing")
+
+		var names []string
+		for m := range strings.SplitSeq(h, ", ") {
+			sub := metric.FindStringSubmatch(m)
+			if sub == nil {
+				t.Errorf("%s: malformed metric %q in %q", tt.target, m, h)
+				continue
+			}
+			if d, err := strconv.ParseFloat(sub[2], 64); err != nil || d < 0 {
+				t.Errorf("%s: duration %q", tt.target, sub[2])
+			}
+			names = append(names, sub[1])
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("%s: metrics %q, want %q", tt.target, names, tt.want)
+		}
+	}
+
+	// cached listings are neither read nor rendered
+	cfg := testConfig(testDir(t, map[string]string{"a.txt": "a"}))
+	cfg.CacheListings = true
+	s = testServer(t, cfg)
+	request(s, http.MethodGet, "/", "Accept", "text/html")
+	w := request(s, http.MethodGet, "/", "Accept", "text/html")
+	if h := w.Header().Get("Server-Timing"); !strings.Contains(h, "cache;dur=") || strings.Contains(h, "render;") {
+		t.Errorf("cached listing: %q", h)
+	}
+}
+
+func TestIgnoreCase(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"README.md":     "readme",
+		"Sub/Notes.txt": "notes",
+		"dup.txt":       "lower",
+		"DUP.txt":       "upper",
+		".Secret":       "s",
+	})
+
+	tests := []struct {
+		target string
+		fold   bool
+		code   int
+		body   string
+	}{
+		{"/README.md", false, http.StatusOK, "readme"},
+		{"/readme.MD", false, http.StatusNotFound, ""},
+		{"/README.md", true, http.StatusOK, "readme"},
+		{"/readme.MD", true, http.StatusOK, "readme"},
+		{"/Sub/notes.TXT", true, http.StatusOK, "notes"},
+		// only the last component is matched
+		{"/sub/Notes.txt", true, http.StatusNotFound, ""},
+		// ambiguous, exact matches are still served
+		{"/Dup.txt", true, http.StatusNotFound, ""},
+		{"/DUP.txt", true, http.StatusOK, "upper"},
+		// hidden files are not revealed
+		{"/.secret", true, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(dir)
+		cfg.Recursive = true
+		cfg.IgnoreCase = tt.fold
+		s := testServer(t, cfg)
+
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != tt.code {
+			t.Errorf("%s (fold=%t): status %d, want %d", tt.target, tt.fold, w.Code, tt.code)
+			continue
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s (fold=%t): body %q, want %q", tt.target, tt.fold, w.Body, tt.body)
+		}
+	}
+}
+
+// Writer of a response that fails once limit bytes of the body
+// were written, like the connection to a client that went away.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if n := w.limit - w.Body.Len(); len(b) > n {
+		w.ResponseRecorder.Write(b[:max(n, 0)])
+		return max(n, 0), errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestTransferLog(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": content})))
+
+	tests := []struct {
+		name  string
+		limit int
+		rng   string
+		want  string
+	}{
+		{"complete", len(content), "", "served file of 100000 bytes"},
+		{"range", len(content), "bytes=0-99", "served 100 bytes of file of 100000 bytes"},
+		{"aborted", 4096, "", "transfer aborted after 4096 of 100000 bytes (write failed)"},
+		{"aborted range", 10, "bytes=0-99", "transfer aborted after 10 of 100 bytes (write failed)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLog(t)
+
+			r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+			w := &failingWriter{httptest.NewRecorder(), tt.limit}
+			s.ServeHTTP(w, r)
+
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("log %q, want %q", buf, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptRanges(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "0123456789"})))
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/a.txt", "bytes"},
+		{"/", ""},
+		{"/?format=json", ""},
+		// generated on the fly, so ranges can't be served
+		{"/?zip=1", "none"},
+	}
+
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			w := request(s, method, tt.target)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %s: status %d", method, tt.target, w.Code)
+			}
+			if got := w.Header().Get("Accept-Ranges"); got != tt.want {
+				t.Errorf("%s %s: Accept-Ranges %q, want %q", method, tt.target, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz"
+	dir := testDir(t, map[string]string{"a.txt": content[:20]})
+	mod := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(dir, "a.txt"), mod, mod)
+	s := testServer(t, testConfig(dir))
+
+	w := request(s, http.MethodGet, "/a.txt")
+	oldETag, oldModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+
+	// the download is resumed after the file changed
+	later := mod.Add(time.Hour)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(dir, "a.txt"), later, later)
+	w = request(s, http.MethodGet, "/a.txt")
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+
+	tests := []struct {
+		name    string
+		ifRange string
+		code    int
+		body    string
+	}{
+		{"current ETag", etag, http.StatusPartialContent, content[10:21]},
+		{"current Last-Modified", modified, http.StatusPartialContent, content[10:21]},
+		{"stale ETag", oldETag, http.StatusOK, content},
+		{"stale Last-Modified", oldModified, http.StatusOK, content},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, "/a.txt", "Range", "bytes=10-20", "If-Range", tt.ifRange)
+		if w.Code != tt.code || w.Body.String() != tt.body {
+			t.Errorf("%s: status %d, body %q, want %d, %q", tt.name, w.Code, w.Body, tt.code, tt.body)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"Report-2024.pdf": "",
+		"report.txt":      "",
+		"notes.txt":       "",
+		"reports/":        "",
+		".report":         "",
+	})
+	s := testServer(t, testConfig(dir))
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		// hidden files are not listed either way
+		{"", []string{"Report-2024.pdf", "notes.txt", "report.txt", "reports"}},
+		{"report", []string{"Report-2024.pdf", "report.txt", "reports"}},
+		{"REPORT.", []string{"report.txt"}},
+		{".txt", []string{"notes.txt", "report.txt"}},
+		{"nothing", nil},
+	}
+
+	for _, tt := range tests {
+		got := listingNames(t, s, "/?"+url.Values{"filter": {tt.filter}}.Encode())
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("filter %q: %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+
+	// the form keeps the filter, which is escaped
+	w := request(s, http.MethodGet, `/?filter=%22%3E.txt`, "Accept", "text/html")
+	body := w.Body.String()
+	if !strings.Contains(body, `<form method="get">`) || !strings.Contains(body, `name="filter" value="&#34;&gt;.txt"`) {
+		t.Errorf("no filter form in %s", body)
+	}
+	if !strings.Contains(body, `<a href="?">show all</a>`) {
+		t.Errorf("no link to show all in %s", body)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "a"})
+
+	tests := []struct {
+		upload bool
+		method string
+		code   int
+		allow  string
+	}{
+		{false, http.MethodDelete, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{false, http.MethodPatch, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{false, http.MethodPut, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{false, http.MethodPost, http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{false, http.MethodOptions, http.StatusNoContent, "GET, HEAD, OPTIONS"},
+		{true, http.MethodDelete, http.StatusMethodNotAllowed, "GET, HEAD, POST, PUT, OPTIONS"},
+		{true, http.MethodOptions, http.StatusNoContent, "GET, HEAD, POST, PUT, OPTIONS"},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(dir)
+		cfg.Upload = tt.upload
+		s := testServer(t, cfg)
+
+		w := request(s, tt.method, "/a.txt")
+		if w.Code != tt.code || w.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s (upload %t): status %d, Allow %q, want %d, %q", tt.method, tt.upload, w.Code, w.Header().Get("Allow"), tt.code, tt.allow)
+		}
+	}
+
+	// nothing happened to the file
+	if b, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(b) != "a" {
+		t.Errorf("a.txt: %q, %v", b, err)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	dir := testDir(t, map[string]string{"a b.txt": "a"})
+
+	tests := []struct {
+		base string
+		want string // empty if invalid
+	}{
+		{"https://files.example.com/share", "https://files.example.com/share"},
+		{"https://files.example.com/share/", "https://files.example.com/share"},
+		{"http://files.example.com:8080", "http://files.example.com:8080"},
+		{"files.example.com/share", ""},
+		{"ftp://files.example.com", ""},
+		{"https://files.example.com/?a=1", ""},
+		{"https:///share", ""},
+	}
+
+	for _, tt := range tests {
+		cfg := testConfig(dir)
+		cfg.BaseURL = tt.base
+		s, err := NewServer(cfg)
+		if tt.want == "" {
+			if err == nil {
+				s.Close()
+				t.Errorf("%q accepted", tt.base)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.base, err)
+			continue
+		}
+		defer s.Close()
+
+		if s.BaseURL() != tt.want {
+			t.Errorf("%q: BaseURL %q, want %q", tt.base, s.BaseURL(), tt.want)
+		}
+	}
+
+	// the base URL replaces the host of the request and headers of
+	// proxies, and it includes the prefix if there is one
+	cfg := testConfig(dir)
+	cfg.BaseURL = "https://files.example.com/share/"
+	cfg.Prefix = "/share"
+	cfg.Manifest = true
+	s := testServer(t, cfg)
+
+	r := httptest.NewRequest(http.MethodGet, "http://localhost:2022/share/~manifest", nil)
+	r.Header.Set("X-Forwarded-Host", "evil.example.com")
+	if got := s.absURL(r, "/a%20b.txt"); got != "https://files.example.com/share/a%20b.txt" {
+		t.Errorf("absURL %q", got)
+	}
+
+	w := send(s, r)
+	if !strings.Contains(w.Body.String(), `"url":"https://files.example.com/share/a%20b.txt"`) {
+		t.Errorf("manifest %s", w.Body)
+	}
+}
+
+// Writer of a response that stalls writing the body after the
+// first write, like a client that stopped reading, until a write
+// deadline is set.
+type stallingWriter struct {
+	*httptest.ResponseRecorder
+	written  chan struct{} // closed on the first write
+	deadline chan struct{} // closed when the deadline is set
+}
+
+func (w *stallingWriter) Write(b []byte) (int, error) {
+	select {
+	case <-w.written:
+	default:
+		close(w.written)
+		return w.ResponseRecorder.Write(b)
+	}
+	<-w.deadline
+	return 0, os.ErrDeadlineExceeded
+}
+
+func (w *stallingWriter) SetWriteDeadline(time.Time) error {
+	select {
+	case <-w.deadline:
+	default:
+		close(w.deadline)
+	}
+	return nil
+}
+
+func TestTransferCanceled(t *testing.T) {
+	const size = 1 << 20
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.bin": strings.Repeat("x", size)})))
+	buf := captureLog(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/a.bin", nil).WithContext(ctx)
+	w := &stallingWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		s.ServeHTTP(w, r)
+		close(done)
+	}()
+
+	<-w.written
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer not stopped after the request was canceled")
+	}
+
+	if n := w.Body.Len(); n == 0 || n >= size {
+		t.Errorf("wrote %d of %d bytes", n, size)
+	}
+	if want := fmt.Sprintf("transfer aborted after %d of %d bytes (client gone)", w.Body.Len(), size); !strings.Contains(buf.String(), want) {
+		t.Errorf("log %q, want %q", buf, want)
+	}
+}
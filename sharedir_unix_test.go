@@ -0,0 +1,39 @@
+//go:build unix
+
+package sharedir
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Reading a fifo would block until something writes to it.
+func TestFifo(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.txt": "a"})
+	if err := syscall.Mkfifo(filepath.Join(dir, "pipe"), 0644); err != nil {
+		t.Skip("can't create fifo:", err)
+	}
+	s := testServer(t, testConfig(dir))
+
+	done := make(chan int)
+	go func() {
+		done <- request(s, http.MethodGet, "/pipe").Code
+	}()
+
+	select {
+	case code := <-done:
+		if code != http.StatusForbidden {
+			t.Errorf("status %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request blocked")
+	}
+
+	if got := listingNames(t, s, "/"); !slices.Equal(got, []string{"a.txt"}) {
+		t.Errorf("listing %q", got)
+	}
+}
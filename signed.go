@@ -0,0 +1,119 @@
+package sharedir
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// URL path of files accessed with signed links, e.g.
+// '/~get?path=/a/b.txt&expires=1700000000&sig=...'. The signature
+// is an HMAC of the path and the expiry with the secret key, so
+// links can't be guessed or changed to other paths.
+const signedPrefix = "/~get"
+
+// Signs and verifies links with a secret key.
+type urlSigner struct {
+	key []byte
+	ttl time.Duration // links expire after it, never if 0
+}
+
+// HMAC of path and expiry (Unix time, 0 if never), hex-encoded.
+func (u *urlSigner) sign(path string, expires int64) string {
+	m := hmac.New(sha256.New, u.key)
+	m.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Signed link to the file at (unescaped) path, without prefix.
+func (u *urlSigner) link(path string) string {
+	var expires int64
+	if u.ttl > 0 {
+		expires = time.Now().Add(u.ttl).Unix()
+	}
+
+	q := url.Values{"path": {path}, "sig": {u.sign(path, expires)}}
+	if expires > 0 {
+		q.Set("expires", strconv.FormatInt(expires, 10))
+	}
+	return signedPrefix + "?" + q.Encode()
+}
+
+// Check the signature of the link with query q. Returns the path
+// it is for, or the status code to fail the request with.
+func (u *urlSigner) verify(q url.Values) (string, int) {
+	var (
+		err     error
+		expires int64
+	)
+
+	path := q.Get("path")
+	if path == "" || !strings.HasPrefix(path, "/") {
+		return "", http.StatusBadRequest
+	}
+
+	if e := q.Get("expires"); e != "" {
+		if expires, err = strconv.ParseInt(e, 10, 64); err != nil || expires <= 0 {
+			return "", http.StatusBadRequest
+		}
+	}
+
+	sig, err := hex.DecodeString(q.Get("sig"))
+	want, _ := hex.DecodeString(u.sign(path, expires))
+	if err != nil || !hmac.Equal(sig, want) {
+		return "", http.StatusForbidden
+	}
+
+	if expires > 0 && time.Now().Unix() > expires {
+		return "", http.StatusForbidden
+	}
+	return path, http.StatusOK
+}
+
+// Serve the file of a signed link. The signature stands in for
+// credentials, auth files are not checked.
+func (s *Server) serveSigned(w http.ResponseWriter, r *http.Request) {
+	if s.signer == nil {
+		serveFailure(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+
+	path, code := s.signer.verify(r.URL.Query())
+	if code != http.StatusOK {
+		serveFailure(w, r, code, "invalid or expired link")
+		return
+	}
+
+	sp := s.parseSafePath(path)
+	if sp == nil || sp.root == "" {
+		serveFailure(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	inf, code := s.statShared(sp)
+	if code != http.StatusOK {
+		serveFailure(w, r, code, http.StatusText(code))
+		return
+	}
+	if inf.IsDir() {
+		serveFailure(w, r, http.StatusBadRequest, "not a file")
+		return
+	}
+
+	if s.once != nil {
+		s.serveOnce(w, r, sp)
+	} else {
+		s.serveFile(w, r, sp)
+	}
+}
+
+// Check if r is for a signed link, which basic authentication
+// lets through.
+func (s *Server) IsSigned(r *http.Request) bool {
+	return s.signer != nil && r.URL.Path == s.prefix+signedPrefix
+}
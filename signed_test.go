@@ -0,0 +1,113 @@
+package sharedir
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignedLinks(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{
+		"a.txt":     "a",
+		"b.txt":     "b",
+		"sub/c.txt": "c",
+	}))
+	cfg.Recursive = true
+	cfg.Secret = "key"
+	cfg.SignedOnly = true
+	s := testServer(t, cfg)
+	signer := &urlSigner{key: []byte("key")}
+
+	// link with query q changed by change
+	link := func(path string, expires int64, change func(q url.Values)) string {
+		q := url.Values{"path": {path}, "sig": {signer.sign(path, expires)}}
+		if expires != 0 {
+			q.Set("expires", strconv.FormatInt(expires, 10))
+		}
+		if change != nil {
+			change(q)
+		}
+		return signedPrefix + "?" + q.Encode()
+	}
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		target string
+		code   int
+		body   string
+	}{
+		{"valid", link("/a.txt", 0, nil), http.StatusOK, "a"},
+		{"subdirectory", link("/sub/c.txt", 0, nil), http.StatusOK, "c"},
+		{"not expired", link("/a.txt", future, nil), http.StatusOK, "a"},
+		{"expired", link("/a.txt", past, nil), http.StatusForbidden, ""},
+		{"other path", link("/a.txt", 0, func(q url.Values) { q.Set("path", "/b.txt") }), http.StatusForbidden, ""},
+		{"extended", link("/a.txt", past, func(q url.Values) { q.Set("expires", strconv.FormatInt(future, 10)) }), http.StatusForbidden, ""},
+		{"expiry removed", link("/a.txt", future, func(q url.Values) { q.Del("expires") }), http.StatusForbidden, ""},
+		{"tampered", link("/a.txt", 0, func(q url.Values) { q.Set("sig", signer.sign("/b.txt", 0)) }), http.StatusForbidden, ""},
+		{"not hex", link("/a.txt", 0, func(q url.Values) { q.Set("sig", "xyz") }), http.StatusForbidden, ""},
+		{"other key", link("/a.txt", 0, func(q url.Values) { q.Set("sig", (&urlSigner{key: []byte("other")}).sign("/a.txt", 0)) }), http.StatusForbidden, ""},
+		{"directory", link("/sub", 0, nil), http.StatusBadRequest, ""},
+		{"outside", link("/../x", 0, nil), http.StatusBadRequest, ""},
+		{"direct", "/a.txt", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, tt.target)
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s: status %d, body %q", tt.name, w.Code, w.Body)
+		}
+	}
+
+	// links of the listing are signed
+	body := request(s, http.MethodGet, "/", "Accept", "text/html").Body.String()
+	m := regexp.MustCompile(`href="(/~get\?[^"]*path=%2Fa.txt[^"]*)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("no signed link in listing")
+	}
+	if w := request(s, http.MethodGet, html.UnescapeString(m[1])); w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Errorf("signed link of listing: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+// Index files are files as well, they are not served when their
+// directory is requested.
+func TestSignedLinksIndex(t *testing.T) {
+	cfg := testConfig(testDir(t, map[string]string{"sub/index.html": "<p>hi</p>"}))
+	cfg.Recursive = true
+	cfg.IndexFile = "index.html"
+	cfg.Secret = "key"
+	cfg.SignedOnly = true
+	s := testServer(t, cfg)
+
+	for _, target := range []string{"/sub/", "/sub/index.html"} {
+		if w := request(s, http.MethodGet, target); w.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, body %q", target, w.Code, w.Body)
+		}
+	}
+
+	signer := &urlSigner{key: []byte("key")}
+	if w := request(s, http.MethodGet, signer.link("/sub/index.html")); w.Code != http.StatusOK || w.Body.String() != "<p>hi</p>" {
+		t.Errorf("signed link: status %d, body %q", w.Code, w.Body)
+	}
+}
+
+func TestSignedLinksDisabled(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "a"})))
+
+	signer := &urlSigner{key: []byte("key")}
+	if w := request(s, http.MethodGet, signer.link("/a.txt")); w.Code != http.StatusNotFound {
+		t.Errorf("status %d", w.Code)
+	}
+
+	cfg := testConfig(testDir(t, nil))
+	cfg.SignedOnly = true
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("signed links without secret accepted")
+	}
+}
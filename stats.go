@@ -0,0 +1,84 @@
+package sharedir
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Number of downloads of each file since startup, by URL path.
+type downloadStats struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newDownloadStats() *downloadStats {
+	return &downloadStats{counts: make(map[string]int)}
+}
+
+func (d *downloadStats) add(path string) {
+	d.mu.Lock()
+	d.counts[path]++
+	d.mu.Unlock()
+}
+
+func (d *downloadStats) copy() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := make(map[string]int, len(d.counts))
+	for k, v := range d.counts {
+		c[k] = v
+	}
+	return c
+}
+
+// Check if request starts a download, i.e. if it's not only for
+// the headers or for continuing one (as players of audio and
+// video do), so that each download is counted once.
+func isDownload(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return r.Method == http.MethodGet && (rng == "" || strings.HasPrefix(rng, "bytes=0-"))
+}
+
+// Serve number of downloads of each file as JSON.
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	// paths of downloaded files would be revealed
+	if s.noListing {
+		serveFailure(w, r, http.StatusForbidden, "listing is disabled")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(struct {
+		Downloads map[string]int `json:"downloads"`
+	}{s.unprotected(s.stats.copy())})
+	if err != nil {
+		log.Printf("     encode json: %v", err)
+	}
+}
+
+// Remove counts of files in directories protected by an auth
+// file, whose names are not for anyone to see. Checked on each
+// request, auth files may have been added since the downloads.
+func (s *Server) unprotected(counts map[string]int) map[string]int {
+	for p := range counts {
+		sp := s.parseSafePath(p)
+		if sp == nil || sp.root == "" {
+			delete(counts, p)
+			continue
+		}
+		if _, a, err := s.authOf(sp, false); a != nil || err != nil {
+			delete(counts, p)
+		}
+	}
+	return counts
+}
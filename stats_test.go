@@ -0,0 +1,95 @@
+package sharedir
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Get the download counts of /~stats.
+func getStats(t *testing.T, h http.Handler) map[string]int {
+	t.Helper()
+
+	w := request(h, http.MethodGet, "/~stats")
+	if w.Code != http.StatusOK {
+		t.Fatalf("stats: status %d", w.Code)
+	}
+
+	var v struct {
+		Downloads map[string]int `json:"downloads"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v.Downloads
+}
+
+// Files in protected directories are not listed, their names
+// are as secret as their content.
+func TestStatsProtected(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"pub.txt":              "a",
+		"priv/" + authFile:     "u:p\n",
+		"priv/secret.txt":      "b",
+		"priv/sub/deeper.txt":  "c",
+		"other/not-secret.txt": "d",
+	})
+	cfg := testConfig(dir)
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	for _, p := range []string{"/pub.txt", "/priv/secret.txt", "/priv/sub/deeper.txt", "/other/not-secret.txt"} {
+		r := httptest.NewRequest(http.MethodGet, p, nil)
+		r.SetBasicAuth("u", "p")
+		if w := send(s, r); w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", p, w.Code)
+		}
+	}
+
+	got := getStats(t, s)
+	for _, p := range []string{"/pub.txt", "/other/not-secret.txt"} {
+		if got[p] != 1 {
+			t.Errorf("%s: %d downloads, want 1", p, got[p])
+		}
+	}
+	for _, p := range []string{"/priv/secret.txt", "/priv/sub/deeper.txt"} {
+		if _, ok := got[p]; ok {
+			t.Errorf("%s is listed", p)
+		}
+	}
+}
+
+func TestStatsDownloads(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "0123456789"})))
+
+	w := request(s, http.MethodGet, "/a.txt")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+
+	tests := []struct {
+		name   string
+		method string
+		header []string
+		code   int
+	}{
+		{"again", http.MethodGet, nil, http.StatusOK},
+		{"head", http.MethodHead, nil, http.StatusOK},
+		{"not modified", http.MethodGet, []string{"If-None-Match", etag}, http.StatusNotModified},
+		{"continued", http.MethodGet, []string{"Range", "bytes=5-"}, http.StatusPartialContent},
+		{"not satisfiable", http.MethodGet, []string{"Range", "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable},
+	}
+
+	for _, tt := range tests {
+		if w := request(s, tt.method, "/a.txt", tt.header...); w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+
+	// the first download and "again"
+	if n := getStats(t, s)["/a.txt"]; n != 2 {
+		t.Errorf("%d downloads, want 2", n)
+	}
+}
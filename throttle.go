@@ -0,0 +1,56 @@
+package sharedir
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Reader limiting the rate at which data is read to rate bytes
+// per second on average, allowing bursts of up to one second.
+// Reading stops early if ctx is done.
+type throttledReader struct {
+	r      io.Reader
+	ctx    context.Context
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newThrottledReader(ctx context.Context, r io.Reader, rate int64) *throttledReader {
+	return &throttledReader{r: r, ctx: ctx, rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	now := time.Now()
+	t.tokens = min(t.tokens+now.Sub(t.last).Seconds()*t.rate, t.rate)
+	t.last = now
+
+	// wait until at least a small chunk may be read
+	chunk := min(float64(len(p)), max(t.rate/10, 1))
+	if t.tokens < chunk {
+		wait := time.Duration((chunk - t.tokens) / t.rate * float64(time.Second))
+		select {
+		case <-time.After(wait):
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		}
+		t.tokens = chunk
+		t.last = time.Now()
+	}
+
+	n, err := t.r.Read(p[:int(min(float64(len(p)), t.tokens))])
+	t.tokens -= float64(n)
+	return n, err
+}
+
+// Same as throttledReader, for content served with
+// http.ServeContent, which needs to seek.
+type throttledReadSeeker struct {
+	*throttledReader
+	s io.Seeker
+}
+
+func (t throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return t.s.Seek(offset, whence)
+}
@@ -0,0 +1,67 @@
+package sharedir
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimit(t *testing.T) {
+	content := strings.Repeat("0123456789", 3000)
+	cfg := testConfig(testDir(t, map[string]string{"a.txt": content}))
+	cfg.BandwidthLimit = 20000
+	s := testServer(t, cfg)
+
+	// a burst of one second, the rest at the limit
+	start := time.Now()
+	w := request(s, http.MethodGet, "/a.txt")
+	elapsed := time.Since(start)
+
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if want := 450 * time.Millisecond; elapsed < want {
+		t.Errorf("took %v, at least %v expected", elapsed, want)
+	}
+}
+
+// Throttled zip archives stop when the request is canceled,
+// instead of being generated at the limit until complete.
+func TestBandwidthLimitZipCanceled(t *testing.T) {
+	// random content doesn't compress, the archive takes about 20s
+	content := make([]byte, 20000)
+	rand.Read(content)
+	cfg := testConfig(testDir(t, map[string]string{"a.bin": string(content)}))
+	cfg.BandwidthLimit = 1000
+	s := testServer(t, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	send(s, httptest.NewRequest(http.MethodGet, "/?zip=1", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v after the request was canceled", elapsed)
+	}
+}
+
+func TestThrottledReaderCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := newThrottledReader(ctx, bytes.NewReader(make([]byte, 1000)), 100)
+
+	// the burst is read at once
+	if n, err := io.ReadFull(tr, make([]byte, 100)); n != 100 || err != nil {
+		t.Fatalf("burst: %d bytes, %v", n, err)
+	}
+
+	cancel()
+	if _, err := tr.Read(make([]byte, 100)); err != context.Canceled {
+		t.Errorf("after cancel: %v", err)
+	}
+}
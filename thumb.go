@@ -0,0 +1,177 @@
+package sharedir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	thumbPrefix = "/~thumb"
+	thumbSize   = 128      // max width and height of thumbnails
+	thumbPixels = 50 << 20 // larger images are not decoded
+	thumbCached = 256      // number of thumbnails kept in memory
+)
+
+var thumbExts = []string{".jpg", ".jpeg", ".png", ".gif"}
+
+// Check if file name is an image of which thumbnails can be
+// generated.
+func thumbable(name string) bool {
+	return slices.Contains(thumbExts, strings.ToLower(filepath.Ext(name)))
+}
+
+// Serve JPEG thumbnail of the image at the "path" query
+// parameter. Paths are checked the same way as for GET.
+func (s *Server) serveThumb(w http.ResponseWriter, r *http.Request) {
+	var (
+		sp   *safePath
+		inf  os.FileInfo
+		code int
+		data []byte
+		err  error
+	)
+
+	if s.once != nil || s.noListing || s.signedOnly {
+		// the image would be shown without being served, or
+		// names of files would be revealed
+		serveFailure(w, r, http.StatusForbidden, "thumbnails are not available")
+		return
+	}
+
+	if sp = s.parseSafePath(r.URL.Query().Get("path")); sp == nil || sp.root == "" {
+		serveFailure(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	if inf, code = s.statShared(sp); code != http.StatusOK {
+		serveFailure(w, r, code, http.StatusText(code))
+		return
+	}
+
+	if !s.authorized(w, r, sp, inf.IsDir()) {
+		return
+	}
+
+	if inf.IsDir() || !thumbable(inf.Name()) {
+		serveFailure(w, r, http.StatusBadRequest, "not an image")
+		return
+	}
+
+	// modified images get a new thumbnail
+	key := fmt.Sprintf("%s\x00%d", sp.abs, inf.ModTime().UnixNano())
+
+	data, ok := s.thumbs.get(key)
+	if !ok {
+		if data, err = makeThumbnail(sp); err != nil {
+			log.Printf("     thumbnail [%s]: %v", sp.abs, err)
+			serveFailure(w, r, http.StatusUnprocessableEntity, "can't read image")
+			return
+		}
+		s.thumbs.put(key, data)
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, "thumb.jpg", inf.ModTime(), bytes.NewReader(data))
+	debugf("     served thumbnail of %d bytes (cached: %t)", len(data), ok)
+}
+
+// Decode image file p and encode a downscaled copy as JPEG.
+func makeThumbnail(p *safePath) ([]byte, error) {
+	var buf bytes.Buffer
+
+	f, err := p.fsys.Open(p.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		return nil, errors.New("file doesn't support seeking")
+	}
+
+	// decoding allocates the whole image, check its size first
+	cfg, _, err := image.DecodeConfig(rs)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > thumbPixels {
+		return nil, fmt.Errorf("image too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	if _, err = rs.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	img, _, err := image.Decode(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = jpeg.Encode(&buf, downscale(img, thumbSize), &jpeg.Options{Quality: 75}); err != nil {
+		return nil, err
+	}
+
+	debugf("     generated thumbnail in %v", time.Since(start))
+	return buf.Bytes(), nil
+}
+
+// Scale image down to fit into a square of the size, averaging
+// the pixels covered by each pixel of the result. Images that
+// already fit are only converted.
+func downscale(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if w > size || h > size {
+		if w > h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < max(y1, y0+1); sy++ {
+				for sx := x0; sx < max(x1, x0+1); sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+
+			// transparent areas become white, JPEG has no alpha
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(bl/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+
+	return dst
+}
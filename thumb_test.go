@@ -0,0 +1,162 @@
+package sharedir
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Encode a PNG image of width and height, red on the left half
+// and blue on the right.
+func testPNG(t *testing.T, width, height int) string {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestThumbnail(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"wide.png":  testPNG(t, 300, 150),
+		"small.png": testPNG(t, 20, 10),
+		"bad.png":   "not an image",
+		"a.txt":     "text",
+		".h.png":    testPNG(t, 10, 10),
+	})
+	cfg := testConfig(dir)
+	cfg.Thumbnails = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		path   string
+		code   int
+		width  int
+		height int
+	}{
+		{"wide.png", http.StatusOK, thumbSize, thumbSize / 2},
+		{"small.png", http.StatusOK, 20, 10},
+		{"bad.png", http.StatusUnprocessableEntity, 0, 0},
+		{"a.txt", http.StatusBadRequest, 0, 0},
+		{".h.png", http.StatusNotFound, 0, 0},
+		{"../wide.png", http.StatusBadRequest, 0, 0},
+		{"", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, tt := range tests {
+		w := request(s, http.MethodGet, thumbPrefix+"?path="+tt.path)
+		if w.Code != tt.code {
+			t.Errorf("%q: status %d, want %d", tt.path, w.Code, tt.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+			t.Errorf("%q: Content-Type %q", tt.path, ct)
+		}
+		img, err := jpeg.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.path, err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+			t.Errorf("%q: %dx%d, want %dx%d", tt.path, b.Dx(), b.Dy(), tt.width, tt.height)
+		}
+
+		// colors survive downscaling, within JPEG's losses
+		r, _, b, _ := img.At(0, 0).RGBA()
+		if r < 0xc000 || b > 0x4000 {
+			t.Errorf("%q: left pixel %v", tt.path, img.At(0, 0))
+		}
+	}
+
+	if s.thumbs.order.Len() != 2 {
+		t.Errorf("%d thumbnails cached, want 2", s.thumbs.order.Len())
+	}
+
+	// the listing links them
+	body := request(s, http.MethodGet, "/", "Accept", "text/html").Body.String()
+	if !strings.Contains(body, `<img src="/~thumb?path=wide.png"`) || strings.Contains(body, "path=a.txt") {
+		t.Errorf("listing without thumbnail links")
+	}
+}
+
+func TestThumbnailDisabled(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.png": testPNG(t, 10, 10)})))
+
+	if w := request(s, http.MethodGet, thumbPrefix+"?path=a.png"); w.Code == http.StatusOK {
+		t.Errorf("status %d", w.Code)
+	}
+	if body := request(s, http.MethodGet, "/", "Accept", "text/html").Body.String(); strings.Contains(body, "<img") {
+		t.Error("thumbnails in listing")
+	}
+}
+
+// Like zip archives, thumbnails are refused where files are only
+// served once or via signed links, or listings are disabled.
+func TestThumbnailRestricted(t *testing.T) {
+	dir := testDir(t, map[string]string{"a.png": testPNG(t, 10, 10)})
+
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+	}{
+		{"once", func(cfg *Config) { cfg.Once = true; cfg.FS = FileFS(filepath.Join(dir, "a.png")) }},
+		{"no listing", func(cfg *Config) { cfg.NoListing = true }},
+		{"signed only", func(cfg *Config) { cfg.Secret = "key"; cfg.SignedOnly = true }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(dir)
+			cfg.Thumbnails = true
+			tt.change(&cfg)
+			s := testServer(t, cfg)
+
+			if w := request(s, http.MethodGet, thumbPrefix+"?path=a.png"); w.Code != http.StatusForbidden {
+				t.Errorf("status %d", w.Code)
+			}
+			if body := request(s, http.MethodGet, "/", "Accept", "text/html").Body.String(); strings.Contains(body, "<img") {
+				t.Error("thumbnails in listing")
+			}
+		})
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache[int](2)
+
+	c.put("a", 1)
+	c.put("b", 2)
+	c.get("a")
+	c.put("c", 3) // evicts b, used least recently
+
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.get(key); !ok || v != want {
+			t.Errorf("%s: %d, %t", key, v, ok)
+		}
+	}
+	if _, ok := c.get("b"); ok {
+		t.Error("b not evicted")
+	}
+}
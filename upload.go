@@ -0,0 +1,478 @@
+package sharedir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Save files of a multipart form into directory p. Existing
+// files are only overwritten with the "overwrite=1" query
+// parameter. Files are streamed to disk as they are received.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, p *safePath) {
+	var (
+		err    error
+		mr     *multipart.Reader
+		part   *multipart.Part
+		count  int
+		status int
+	)
+
+	overwrite := r.URL.Query().Get("overwrite") == "1"
+
+	// server's read timeout is meant for requests without large bodies
+	if err = http.NewResponseController(w).SetReadDeadline(time.Time{}); err != nil {
+		debugf("     reset read deadline: %v", err)
+	}
+
+	if mr, err = r.MultipartReader(); err != nil {
+		log.Printf("     read form: %v", err)
+		serveFailure(w, r, http.StatusBadRequest, "expected multipart form")
+		return
+	}
+
+	for {
+		if part, err = mr.NextPart(); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Printf("     read form: %v", err)
+			serveFailure(w, r, http.StatusBadRequest, "invalid form")
+			return
+		}
+
+		// other form fields are ignored
+		if part.FileName() == "" {
+			continue
+		}
+
+		if status, err = s.saveUpload(p, part, overwrite); err != nil {
+			log.Printf("     upload [%s]: %v", part.FileName(), err)
+			serveFailure(w, r, status, err.Error())
+			return
+		}
+		count += 1
+	}
+
+	infof("     uploaded %d files", count)
+	// back to the listing
+	http.Redirect(w, r, s.prefix+r.URL.Path, http.StatusSeeOther)
+}
+
+// Write uploaded file into directory p. On failure returns
+// an error suitable for the client and the status code.
+func (s *Server) saveUpload(p *safePath, part *multipart.Part, overwrite bool) (int, error) {
+	return s.saveFile(p, part.FileName(), part, overwrite)
+}
+
+// Check the name of a file uploaded into directory p. Returns
+// the path to write to and the flags to open it with, or an
+// error suitable for the client and the status code.
+func (s *Server) uploadTarget(p *safePath, filename string, overwrite bool) (string, int, int, error) {
+	// browsers send base names only, but others might not
+	name := filepath.Base(filepath.Clean("/" + strings.ReplaceAll(filename, "\\", "/")))
+	if name == "/" || name == "." || (isHidden(name) && !s.hidden) {
+		return "", 0, http.StatusBadRequest, errors.New("invalid filename")
+	}
+	// they control access to the directory, and case may not
+	// matter to the file system
+	if strings.EqualFold(name, authFile) || strings.EqualFold(name, ignoreFile) {
+		return "", 0, http.StatusForbidden, errors.New("reserved filename")
+	}
+
+	target := filepath.Join(p.abs, name)
+	if !inRoot(target, p.root) {
+		return "", 0, http.StatusBadRequest, errors.New("invalid filename")
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if inf, err := os.Lstat(target); err == nil {
+		// never write through symlinks or replace directories
+		if !overwrite || !inf.Mode().IsRegular() {
+			return "", 0, http.StatusConflict, errors.New("file exists")
+		}
+		flag = os.O_WRONLY | os.O_TRUNC
+	}
+
+	return target, flag, http.StatusOK, nil
+}
+
+// Write src as file filename into directory p. On failure
+// returns an error suitable for the client and the status code.
+func (s *Server) saveFile(p *safePath, filename string, src io.Reader, overwrite bool) (int, error) {
+	var (
+		err    error
+		f      *os.File
+		n      int64
+		flag   int
+		status int
+		target string
+	)
+
+	if target, flag, status, err = s.uploadTarget(p, filename, overwrite); err != nil {
+		return status, err
+	}
+
+	if f, err = os.OpenFile(target, flag, 0644); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return http.StatusConflict, errors.New("file exists")
+		}
+		return http.StatusInternalServerError, errors.New("server error")
+	}
+
+	// larger files wouldn't be shared
+	if s.maxSize > 0 {
+		src = io.LimitReader(src, s.maxSize+1)
+	}
+
+	if n, err = io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(target)
+		return http.StatusBadRequest, errors.New("upload interrupted")
+	}
+	if s.maxSize > 0 && n > s.maxSize {
+		f.Close()
+		os.Remove(target)
+		return http.StatusRequestEntityTooLarge, errors.New("file too large")
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(target)
+		return http.StatusInternalServerError, errors.New("server error")
+	}
+
+	infof("     saved [%s]", target)
+	return http.StatusOK, nil
+}
+
+// Save the body of a PUT request as file p. Large files can be
+// sent in chunks, each with a header like
+//
+//	Content-Range: bytes 0-1048575/52428800
+//
+// Chunks are appended to a partial upload in partialDir, which
+// is moved into the directory once it is complete. The response
+// to each chunk tells the client how much was received in the
+// Upload-Offset header. After an interruption, the client can
+// ask for it with an empty body and 'Content-Range: bytes */TOTAL',
+// and continue from there.
+func (s *Server) servePut(w http.ResponseWriter, r *http.Request, p *safePath) {
+	dir := s.parseSafePath(path.Dir(strings.TrimSuffix(r.URL.Path, "/")))
+	if dir == nil || dir.root == "" || strings.HasSuffix(r.URL.Path, "/") {
+		serveFailure(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	inf, code := s.statShared(dir)
+	if code != http.StatusOK {
+		serveFailure(w, r, code, http.StatusText(code))
+		return
+	}
+	if !inf.IsDir() {
+		serveFailure(w, r, http.StatusConflict, "not a directory")
+		return
+	}
+	if !s.authorized(w, r, dir, true) {
+		return
+	}
+
+	// server's read timeout is meant for requests without large bodies
+	if err := http.NewResponseController(w).SetReadDeadline(time.Time{}); err != nil {
+		debugf("     reset read deadline: %v", err)
+	}
+
+	overwrite := r.URL.Query().Get("overwrite") == "1"
+	name := path.Base(p.rel)
+
+	cr := r.Header.Get("Content-Range")
+	if cr == "" {
+		// fail early if the size is known, the limit is checked
+		// while saving otherwise
+		if s.maxSize > 0 && r.ContentLength > s.maxSize {
+			serveFailure(w, r, http.StatusRequestEntityTooLarge, "file too large")
+			return
+		}
+		if status, err := s.saveFile(dir, name, r.Body, overwrite); err != nil {
+			log.Printf("     upload [%s]: %v", name, err)
+			serveFailure(w, r, status, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	start, end, total, err := parseContentRange(cr)
+	if err != nil {
+		serveFailure(w, r, http.StatusBadRequest, "invalid Content-Range")
+		return
+	}
+	if s.maxSize > 0 && total > s.maxSize {
+		serveFailure(w, r, http.StatusRequestEntityTooLarge, "file too large")
+		return
+	}
+
+	// fail early, rather than after the last chunk
+	target, _, status, err := s.uploadTarget(dir, name, overwrite)
+	if err != nil {
+		serveFailure(w, r, status, err.Error())
+		return
+	}
+
+	// partial uploads are kept by target and size, so that a
+	// different file uploaded under the same name starts over
+	key := partialKey(target, total)
+	if !s.partials.acquire(key) {
+		serveFailure(w, r, http.StatusConflict, "upload in progress")
+		return
+	}
+	defer s.partials.release(key)
+
+	offset, status, err := s.partials.write(key, r.Body, start, end)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		log.Printf("     upload [%s]: %v", name, err)
+		serveFailure(w, r, status, err.Error())
+		return
+	}
+
+	if offset < total {
+		debugf("     received %d of %d bytes of [%s]", offset, total, target)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if status, err = s.finishUpload(key, dir, name, overwrite); err != nil {
+		log.Printf("     upload [%s]: %v", name, err)
+		serveFailure(w, r, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Parse Content-Range header of an upload chunk. start is -1 for
+// 'bytes */TOTAL', which asks for the offset to continue at.
+func parseContentRange(v string) (start, end, total int64, err error) {
+	errInvalid := errors.New("invalid Content-Range")
+
+	rng, size, ok := strings.Cut(strings.TrimPrefix(v, "bytes "), "/")
+	if !ok || !strings.HasPrefix(v, "bytes ") {
+		return 0, 0, 0, errInvalid
+	}
+	if total, err = strconv.ParseInt(size, 10, 64); err != nil || total < 0 {
+		return 0, 0, 0, errInvalid
+	}
+
+	if rng == "*" {
+		return -1, -1, total, nil
+	}
+
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, errInvalid
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, errInvalid
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start || end >= total {
+		return 0, 0, 0, errInvalid
+	}
+	return start, end, total, nil
+}
+
+// Partial uploads not continued for this long are removed.
+const partialExpiry = 24 * time.Hour
+
+// Chunked uploads in progress, only one request at a time can
+// write to each.
+type partialUploads struct {
+	dir string // see partialDir
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// Find or create the directory of partial uploads, and remove
+// those that expired.
+func newPartialUploads() (*partialUploads, error) {
+	dir, err := partialDir()
+	if err != nil {
+		return nil, err
+	}
+	debugf("partial uploads in [%s]", dir)
+
+	u := &partialUploads{dir: dir, busy: make(map[string]bool)}
+	u.removeExpired()
+	return u, nil
+}
+
+// Directory of partial uploads, only accessible by the user
+// running the server, since their names follow from the targets.
+// In the user's cache directory, so that they are kept across
+// restarts until they are complete or expire, or else in a new
+// temporary directory.
+func partialDir() (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		debugf("user cache dir: %v", err)
+		return os.MkdirTemp("", "sharedir-uploads-")
+	}
+
+	dir := filepath.Join(cache, "sharedir", "uploads")
+	if err = os.MkdirAll(filepath.Dir(dir), 0700); err != nil {
+		return "", err
+	}
+	if err = os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+
+	// it might have been created by someone else
+	inf, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if err = checkPrivateDir(inf); err != nil {
+		return "", fmt.Errorf("[%s]: %w", dir, err)
+	}
+	return dir, nil
+}
+
+func partialKey(target string, total int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", target, total)))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (u *partialUploads) acquire(key string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.busy[key] {
+		return false
+	}
+	u.busy[key] = true
+	return true
+}
+
+func (u *partialUploads) release(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.busy, key)
+}
+
+// Append the chunk from start to end (inclusive) read from src to
+// partial upload key, start -1 only queries its size. Whatever is
+// received is kept, even if src fails. Returns the size of the
+// partial upload, and the status code and error for the client
+// on failure.
+func (u *partialUploads) write(key string, src io.Reader, start, end int64) (int64, int, error) {
+	var (
+		err error
+		f   *os.File
+		inf os.FileInfo
+		n   int64
+	)
+
+	if f, err = os.OpenFile(filepath.Join(u.dir, key), os.O_WRONLY|os.O_CREATE|os.O_APPEND|oNoFollow, 0600); err != nil {
+		log.Printf("     open partial upload: %v", err)
+		return 0, http.StatusInternalServerError, errors.New("server error")
+	}
+	defer f.Close()
+
+	if inf, err = f.Stat(); err != nil {
+		return 0, http.StatusInternalServerError, errors.New("server error")
+	}
+
+	if start < 0 {
+		// touch, so that it doesn't expire while the client pauses
+		now := time.Now()
+		os.Chtimes(f.Name(), now, now)
+		return inf.Size(), http.StatusOK, nil
+	}
+	if start != inf.Size() {
+		return inf.Size(), http.StatusConflict, errors.New("chunk doesn't continue at Upload-Offset")
+	}
+
+	n, err = io.Copy(f, io.LimitReader(src, end-start+1))
+	if err == nil && n < end-start+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return start + n, http.StatusBadRequest, errors.New("upload interrupted")
+	}
+
+	if err = f.Close(); err != nil {
+		return start, http.StatusInternalServerError, errors.New("server error")
+	}
+	return end + 1, http.StatusOK, nil
+}
+
+// Move the complete upload key into directory p as filename.
+// Falls back to copying if the directory of partial uploads is
+// on another file system.
+func (s *Server) finishUpload(key string, p *safePath, filename string, overwrite bool) (int, error) {
+	src := filepath.Join(s.partials.dir, key)
+
+	target, flag, status, err := s.uploadTarget(p, filename, overwrite)
+	if err != nil {
+		return status, err
+	}
+
+	f, err := os.OpenFile(src, os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		log.Printf("     open partial upload: %v", err)
+		return http.StatusInternalServerError, errors.New("server error")
+	}
+	defer f.Close()
+
+	// like files written by saveFile
+	if err = f.Chmod(0644); err != nil {
+		return http.StatusInternalServerError, errors.New("server error")
+	}
+
+	if flag&os.O_EXCL != 0 {
+		// unlike rename, fails if the file was created meanwhile
+		err = os.Link(src, target)
+		if errors.Is(err, os.ErrExist) {
+			return http.StatusConflict, errors.New("file exists")
+		}
+		if err == nil {
+			os.Remove(src)
+		}
+	} else {
+		err = os.Rename(src, target)
+	}
+	if err == nil {
+		infof("     saved [%s]", target)
+		return http.StatusOK, nil
+	}
+	debugf("     move partial upload: %v", err)
+
+	defer os.Remove(src)
+	return s.saveFile(p, filename, f, overwrite)
+}
+
+// Remove partial uploads that expired.
+func (u *partialUploads) removeExpired() {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if inf, err := e.Info(); err == nil && time.Since(inf.ModTime()) > partialExpiry {
+			debugf("remove expired upload [%s]", e.Name())
+			os.Remove(filepath.Join(u.dir, e.Name()))
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package sharedir
+
+import (
+	"errors"
+	"os"
+)
+
+// No such flag, the directory of partial uploads is per user.
+const oNoFollow = 0
+
+// Check that inf, from os.Lstat, is a directory. Permissions
+// follow from the location in the user's profile.
+func checkPrivateDir(inf os.FileInfo) error {
+	if !inf.IsDir() {
+		return errors.New("not a directory")
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package sharedir
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Request uploading files by name with multipart POST to target.
+func uploadRequest(t testing.TB, target string, files map[string]string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(content))
+	}
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// Keep partial uploads of the test in a temporary cache
+// directory, and return the path they are kept in.
+func testCache(t *testing.T) string {
+	t.Helper()
+
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	t.Setenv("HOME", cache)
+	return filepath.Join(cache, "sharedir", "uploads")
+}
+
+// Names of files controlling access must not be uploaded, which
+// would let anyone allowed to upload change who may read.
+func TestUploadReservedName(t *testing.T) {
+	testCache(t)
+	for _, hidden := range []bool{false, true} {
+		dir := testDir(t, nil)
+		cfg := testConfig(dir)
+		cfg.Upload = true
+		cfg.Hidden = hidden
+		s := testServer(t, cfg)
+
+		for _, name := range []string{authFile, ignoreFile, strings.ToUpper(authFile)} {
+			chunk := httptest.NewRequest(http.MethodPut, "/"+name, strings.NewReader("u:p\n"))
+			chunk.Header.Set("Content-Range", "bytes 0-3/4")
+
+			tests := []struct {
+				method string
+				r      *http.Request
+			}{
+				{"PUT", httptest.NewRequest(http.MethodPut, "/"+name, strings.NewReader("u:p\n"))},
+				{"POST", uploadRequest(t, "/", map[string]string{name: "u:p\n"})},
+				{"chunked PUT", chunk},
+			}
+
+			for _, tt := range tests {
+				if w := send(s, tt.r); w.Code < 400 {
+					t.Errorf("%s %s (hidden %t): status %d", tt.method, name, hidden, w.Code)
+				}
+				if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+					t.Fatalf("%s %s (hidden %t): file created", tt.method, name, hidden)
+				}
+			}
+		}
+	}
+}
+
+func TestPutMaxSize(t *testing.T) {
+	testCache(t)
+	dir := testDir(t, map[string]string{"old.txt": "old"})
+	cfg := testConfig(dir)
+	cfg.Upload = true
+	cfg.MaxSize = 3
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		length int64 // -1 if unknown, i.e. chunked transfer encoding
+		code   int
+	}{
+		{"small", "/small.txt", "abc", 3, http.StatusCreated},
+		{"large", "/large.txt", "0123456789", 10, http.StatusRequestEntityTooLarge},
+		{"large, unknown length", "/large2.txt", "0123456789", -1, http.StatusRequestEntityTooLarge},
+		{"overwrite", "/old.txt?overwrite=1", "0123456789", 10, http.StatusRequestEntityTooLarge},
+		{"chunked", "/chunked.txt", "0123456789", 10, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, tt.target, strings.NewReader(tt.body))
+			r.ContentLength = tt.length
+			if tt.name == "chunked" {
+				r.Header.Set("Content-Range", "bytes 0-9/10")
+			}
+
+			if w := send(s, r); w.Code != tt.code {
+				t.Errorf("status %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+
+	for name, want := range map[string]string{"small.txt": "abc", "old.txt": "old"} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != want {
+			t.Errorf("%s: %q, %v", name, b, err)
+		}
+	}
+	for _, name := range []string{"large.txt", "large2.txt", "chunked.txt"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s was created", name)
+		}
+	}
+}
+
+// Send the chunk of content from start to end (inclusive) of a
+// file of total bytes to target.
+func putChunk(h http.Handler, target, content string, start, end, total int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, target, strings.NewReader(content[start:end+1]))
+	return send(h, r, "Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+}
+
+func TestPutChunks(t *testing.T) {
+	partials := testCache(t)
+	dir := testDir(t, nil)
+	cfg := testConfig(dir)
+	cfg.Upload = true
+	s := testServer(t, cfg)
+
+	const content = "0123456789"
+
+	if w := putChunk(s, "/f.txt", content, 0, 3, 10); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("first chunk: status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	// not continuing where the first one ended
+	if w := putChunk(s, "/f.txt", content, 6, 9, 10); w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("gap: status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// resumed after an interruption, by asking where to continue
+	r := httptest.NewRequest(http.MethodPut, "/f.txt", nil)
+	if w := send(s, r, "Content-Range", "bytes */10"); w.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("query: status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	if w := putChunk(s, "/f.txt", content, 4, 9, 10); w.Code != http.StatusCreated {
+		t.Fatalf("last chunk: status %d", w.Code)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "f.txt"))
+	if err != nil || string(b) != content {
+		t.Errorf("saved %q, %v", b, err)
+	}
+
+	inf, err := os.Lstat(partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inf.Mode().Perm() != 0700 {
+		t.Errorf("partial uploads in directory with mode %s", inf.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(partials); len(entries) != 0 {
+		t.Errorf("%d partial uploads left", len(entries))
+	}
+}
+
+func TestPutWhole(t *testing.T) {
+	testCache(t)
+	dir := testDir(t, map[string]string{"old.txt": "old"})
+	cfg := testConfig(dir)
+	cfg.Upload = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		target string
+		code   int
+		want   string
+	}{
+		{"/new.txt", http.StatusCreated, "new"},
+		{"/old.txt", http.StatusConflict, "old"},
+		{"/old.txt?overwrite=1", http.StatusCreated, "new"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPut, tt.target, strings.NewReader("new"))
+		if w := send(s, r); w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.code)
+		}
+		name := strings.TrimPrefix(strings.Split(tt.target, "?")[0], "/")
+		if b, _ := os.ReadFile(filepath.Join(dir, name)); string(b) != tt.want {
+			t.Errorf("%s: content %q, want %q", tt.target, b, tt.want)
+		}
+	}
+}
+
+// The directory of partial uploads must not be usable by others,
+// who could read uploads or make them write elsewhere.
+func TestPartialDirNotPrivate(t *testing.T) {
+	partials := testCache(t)
+	if err := os.MkdirAll(partials, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(partials, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(testDir(t, nil))
+	cfg.Upload = true
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("directory with mode 0777 accepted")
+	}
+
+	if err := os.Remove(partials); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(t.TempDir(), partials); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(cfg); err == nil {
+		t.Error("symlink accepted")
+	}
+}
+
+// Partial uploads are never written through symlinks.
+func TestPutChunkSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no O_NOFOLLOW")
+	}
+
+	partials := testCache(t)
+	dir := testDir(t, nil)
+	cfg := testConfig(dir)
+	cfg.Upload = true
+	s := testServer(t, cfg)
+
+	victim := filepath.Join(t.TempDir(), "victim")
+	if err := os.WriteFile(victim, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := partialKey(filepath.Join(dir, "f.txt"), 10)
+	if err := os.Symlink(victim, filepath.Join(partials, key)); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := putChunk(s, "/f.txt", "0123456789", 0, 3, 10); w.Code < 400 {
+		t.Errorf("status %d", w.Code)
+	}
+	if b, _ := os.ReadFile(victim); string(b) != "keep" {
+		t.Errorf("symlink followed, target contains %q", b)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	testCache(t)
+	dir := testDir(t, map[string]string{"old.txt": "old", "sub/": ""})
+	cfg := testConfig(dir)
+	cfg.Upload = true
+	cfg.Recursive = true
+	s := testServer(t, cfg)
+
+	tests := []struct {
+		name   string
+		target string
+		file   string
+		code   int
+		path   string // where the file is expected, relative to dir
+		want   string
+	}{
+		{"new", "/", "new.txt", http.StatusSeeOther, "new.txt", "content"},
+		{"subdirectory", "/sub/", "new.txt", http.StatusSeeOther, "sub/new.txt", "content"},
+		{"exists", "/", "old.txt", http.StatusConflict, "old.txt", "old"},
+		{"overwrite", "/?overwrite=1", "old.txt", http.StatusSeeOther, "old.txt", "content"},
+		{"traversal", "/sub/", "../../escaped.txt", http.StatusSeeOther, "sub/escaped.txt", "content"},
+		{"backslashes", "/", `..\..\win.txt`, http.StatusSeeOther, "win.txt", "content"},
+		{"directory", "/", "sub", http.StatusConflict, "", ""},
+		{"hidden", "/", ".hidden", http.StatusBadRequest, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(s, uploadRequest(t, tt.target, map[string]string{tt.file: "content"}))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.path == "" {
+				return
+			}
+			b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(tt.path)))
+			if err != nil || string(b) != tt.want {
+				t.Errorf("%s: %q, %v", tt.path, b, err)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped.txt")); err == nil {
+		t.Error("file written outside root")
+	}
+
+	// the listing offers the form
+	if body := request(s, http.MethodGet, "/", "Accept", "text/html").Body.String(); !strings.Contains(body, "multipart/form-data") {
+		t.Error("no upload form in listing")
+	}
+}
+
+func TestUploadDisabled(t *testing.T) {
+	dir := testDir(t, nil)
+	s := testServer(t, testConfig(dir))
+
+	if w := send(s, uploadRequest(t, "/", map[string]string{"a.txt": "a"})); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d", w.Code)
+	}
+	if w := send(s, httptest.NewRequest(http.MethodPut, "/a.txt", strings.NewReader("a"))); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: status %d", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.txt")); err == nil {
+		t.Error("file created")
+	}
+	if body := request(s, http.MethodGet, "/", "Accept", "text/html").Body.String(); strings.Contains(body, "multipart/form-data") {
+		t.Error("upload form in listing")
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package sharedir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Open partial uploads, never what a symlink points to.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// Check that inf, from os.Lstat, is a directory that only the
+// current user can access.
+func checkPrivateDir(inf os.FileInfo) error {
+	if !inf.IsDir() {
+		return errors.New("not a directory")
+	}
+	if st, ok := inf.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("owned by uid %d", st.Uid)
+	}
+	if inf.Mode().Perm() != 0700 {
+		return fmt.Errorf("mode %s, want 0700", inf.Mode().Perm())
+	}
+	return nil
+}
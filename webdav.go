@@ -0,0 +1,263 @@
+package sharedir
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// URL path of read-only WebDAV (class 1) access to the shared
+// directories, so that they can be mounted as a network drive.
+// An entry named "dav" at the top of the share is hidden by it.
+const davPrefix = "/dav"
+
+// Methods needed for browsing and reading, the others are refused.
+const davMethods = "OPTIONS, GET, HEAD, PROPFIND"
+
+// Create WebDAV handler for the shared directories. Its paths
+// include the URL path prefix, since it builds links from them.
+func (s *Server) newDAVHandler() *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     s.prefix + davPrefix,
+		FileSystem: davFS{s},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				debugf("     webdav: %v", err)
+			}
+		},
+	}
+}
+
+// Handle WebDAV request. Files are read with the regular GET
+// handling, properties are served by golang.org/x/net/webdav.
+// Paths are checked the same way for both.
+func (s *Server) serveDAV(w http.ResponseWriter, r *http.Request) {
+	raw := "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, davPrefix), "/")
+
+	switch r.Method {
+	case http.MethodOptions:
+		// not the one of webdav.Handler, which offers locking
+		w.Header().Set("DAV", "1")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", davMethods)
+		return
+	case http.MethodGet, http.MethodHead:
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = raw
+		r2.URL.RawPath = ""
+		s.serve(w, r2)
+		return
+	case "PROPFIND":
+	default:
+		w.Header().Set("Allow", davMethods)
+		serveFailure(w, r, http.StatusMethodNotAllowed, "read-only")
+		return
+	}
+
+	sp := s.parseSafePath(raw)
+	if sp == nil {
+		serveFailure(w, r, http.StatusBadRequest, "invalid path")
+		return
+	}
+
+	if sp.root != "" {
+		inf, code := s.statShared(sp)
+		if code != http.StatusOK {
+			serveFailure(w, r, code, http.StatusText(code))
+			return
+		}
+		if !s.authorized(w, r, sp, inf.IsDir()) {
+			return
+		}
+	}
+
+	// "infinity" is treated as 1, clients browse level by level,
+	// and subdirectories may be protected by other credentials
+	r2 := r.Clone(r.Context())
+	if r.Header.Get("Depth") != "0" {
+		r2.Header.Set("Depth", "1")
+	}
+	r2.URL.Path = s.prefix + davPrefix + raw
+	r2.URL.RawPath = ""
+	s.dav.ServeHTTP(w, r2)
+}
+
+// Read-only webdav.FileSystem of the shared directories, with
+// the same paths as under "/".
+type davFS struct {
+	s *Server
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	sp, inf, err := d.stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if sp.root == "" {
+		return &davFile{s: d.s, sp: sp, inf: inf}, nil
+	}
+
+	f, err := sp.fsys.Open(sp.name)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: f, s: d.s, sp: sp, inf: inf}, nil
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	_, inf, err := d.stat(name)
+	return inf, err
+}
+
+// Resolve and check the path name, like a regular request.
+func (d davFS) stat(name string) (*safePath, os.FileInfo, error) {
+	sp := d.s.parseSafePath(name)
+	if sp == nil {
+		return nil, nil, os.ErrNotExist
+	}
+
+	// top-level list of mounts, not backed by a directory
+	if sp.root == "" {
+		return sp, mountsInfo{d.s.started}, nil
+	}
+
+	inf, code := d.s.statShared(sp)
+	switch code {
+	case http.StatusOK:
+		return sp, inf, nil
+	case http.StatusForbidden:
+		return nil, nil, os.ErrPermission
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// Shared file or directory opened over WebDAV. Directories list
+// only shared entries. File is nil for the list of mounts.
+type davFile struct {
+	fs.File
+	s   *Server
+	sp  *safePath
+	inf os.FileInfo
+}
+
+func (f *davFile) Close() error {
+	if f.File == nil {
+		return nil
+	}
+	return f.File.Close()
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.File == nil {
+		return 0, io.EOF
+	}
+	return f.File.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, os.ErrInvalid
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return f.inf, nil
+}
+
+// Entries of the directory, all at once regardless of count.
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+
+	if !f.inf.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	// names are not revealed, like in listings
+	if f.s.noListing {
+		return nil, nil
+	}
+
+	if f.sp.root == "" {
+		for i, m := range f.s.mounts {
+			if inf, code := f.s.statShared(f.s.rootPath(&f.s.mounts[i])); code == http.StatusOK {
+				infos = append(infos, namedInfo{inf, m.name})
+			}
+		}
+		return infos, nil
+	}
+
+	entries, err := fs.ReadDir(f.sp.fsys, f.sp.name)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range f.s.filterEntries(f.sp, entries) {
+		// of the target of symlinks
+		if inf, code := f.s.statShared(f.sp.child(e.Name())); code == http.StatusOK {
+			infos = append(infos, inf)
+		}
+	}
+	return infos, nil
+}
+
+// Content type as for GET, including types set in Config.MimeTypes.
+func (f *davFile) ContentType(ctx context.Context) (string, error) {
+	if rs, ok := f.File.(io.ReadSeeker); ok {
+		return f.s.guessMimeType(f.sp.rel, rs)
+	}
+	return f.s.guessMimeType(f.sp.rel, nil)
+}
+
+// ETag as for GET, so that clients can tell if a file changed.
+func (f *davFile) ETag(ctx context.Context) (string, error) {
+	return fileETag(f.inf), nil
+}
+
+// File info with a different name, e.g. of a mount.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (i namedInfo) Name() string {
+	return i.name
+}
+
+// File info of the top-level list of mounts.
+type mountsInfo struct {
+	started time.Time
+}
+
+func (mountsInfo) Name() string         { return "/" }
+func (mountsInfo) Size() int64          { return 0 }
+func (mountsInfo) Mode() os.FileMode    { return os.ModeDir | 0555 }
+func (i mountsInfo) ModTime() time.Time { return i.started }
+func (mountsInfo) IsDir() bool          { return true }
+func (mountsInfo) Sys() any             { return nil }
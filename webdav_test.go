@@ -0,0 +1,137 @@
+package sharedir
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Response of PROPFIND, only the parts the tests look at.
+type multistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+	} `xml:"response"`
+}
+
+// Send PROPFIND for target to the server at url, as file managers
+// do when browsing, and return the hrefs of the response.
+func propfind(t *testing.T, url, target, depth string) ([]string, int) {
+	t.Helper()
+
+	body := `<?xml version="1.0"?><propfind xmlns="DAV:"><allprop/></propfind>`
+	r, err := http.NewRequest("PROPFIND", url+target, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Depth", depth)
+	r.Header.Set("Content-Type", "application/xml")
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusMultiStatus {
+		return nil, res.StatusCode
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		t.Fatal(err)
+	}
+	var hrefs []string
+	for _, r := range ms.Responses {
+		hrefs = append(hrefs, r.Href)
+	}
+	slices.Sort(hrefs)
+	return hrefs, res.StatusCode
+}
+
+func TestWebDAV(t *testing.T) {
+	dir := testDir(t, map[string]string{
+		"a.txt":     "hello",
+		".hidden":   "h",
+		"sub/b.txt": "b",
+	})
+	cfg := testConfig(dir)
+	cfg.WebDAV = true
+	cfg.Recursive = true
+	ts := httptest.NewServer(testServer(t, cfg))
+	defer ts.Close()
+
+	t.Run("options", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodOptions, ts.URL+"/dav/", nil)
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.Header.Get("DAV") == "" || strings.Contains(res.Header.Get("Allow"), "PUT") {
+			t.Errorf("DAV %q, Allow %q", res.Header.Get("DAV"), res.Header.Get("Allow"))
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		hrefs, code := propfind(t, ts.URL, "/dav/", "1")
+		want := []string{"/dav/", "/dav/a.txt", "/dav/sub/"}
+		if code != http.StatusMultiStatus || !slices.Equal(hrefs, want) {
+			t.Errorf("status %d, hrefs %q, want %q", code, hrefs, want)
+		}
+	})
+
+	t.Run("infinite depth", func(t *testing.T) {
+		// one level only, like Depth 1
+		hrefs, _ := propfind(t, ts.URL, "/dav/", "infinity")
+		if slices.Contains(hrefs, "/dav/sub/b.txt") {
+			t.Errorf("hrefs %q", hrefs)
+		}
+	})
+
+	t.Run("read", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/dav/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(b) != "hello" {
+			t.Errorf("status %d, body %q", res.StatusCode, b)
+		}
+	})
+
+	t.Run("not shared", func(t *testing.T) {
+		if _, code := propfind(t, ts.URL, "/dav/.hidden", "0"); code != http.StatusNotFound {
+			t.Errorf("hidden: status %d", code)
+		}
+		if _, code := propfind(t, ts.URL, "/dav/../", "0"); code == http.StatusMultiStatus {
+			t.Errorf("outside: status %d", code)
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		for _, method := range []string{http.MethodPut, http.MethodDelete, "MKCOL", "MOVE", "PROPPATCH", "LOCK"} {
+			r, _ := http.NewRequest(method, ts.URL+"/dav/a.txt", strings.NewReader("x"))
+			res, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusMethodNotAllowed {
+				t.Errorf("%s: status %d", method, res.StatusCode)
+			}
+		}
+	})
+}
+
+func TestWebDAVDisabled(t *testing.T) {
+	s := testServer(t, testConfig(testDir(t, map[string]string{"a.txt": "a"})))
+
+	r := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	if w := send(s, r, "Depth", "1"); w.Code == http.StatusMultiStatus {
+		t.Errorf("status %d", w.Code)
+	}
+}